@@ -0,0 +1,108 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+const (
+	setAccountInfoURL    = "https://www.googleapis.com/identitytoolkit/v3/relyingparty/setAccountInfo"
+	identityToolkitScope = "https://www.googleapis.com/auth/identitytoolkit"
+)
+
+// setAccountInfoRequest is the payload of the setAccountInfo API.
+// gitkit.Client.UpdateUser only sends the email address, display name,
+// password and email verification, so the updates changing other fields are
+// sent directly.
+type setAccountInfoRequest struct {
+	LocalID        string   `json:"localId"`
+	Email          string   `json:"email,omitempty"`
+	DisplayName    string   `json:"displayName,omitempty"`
+	Password       string   `json:"password,omitempty"`
+	EmailVerified  *bool    `json:"emailVerified,omitempty"`
+	PhotoURL       string   `json:"photoUrl,omitempty"`
+	DisableUser    *bool    `json:"disableUser,omitempty"`
+	DeleteProvider []string `json:"deleteProvider,omitempty"`
+}
+
+// empty reports whether the request changes none of the fields which
+// UpdateUser does not send.
+func (r *setAccountInfoRequest) empty() bool {
+	return r.PhotoURL == "" && r.DisableUser == nil && len(r.DeleteProvider) == 0
+}
+
+// authorizedClient returns the HTTP client authorized with the service
+// account key file, or with the default credentials if path is empty, as the
+// gitkit client is.
+func authorizedClient(ctx context.Context, path string) (*http.Client, error) {
+	if path == "" {
+		return google.DefaultClient(ctx, identityToolkitScope)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := google.JWTConfigFromJSON(b, identityToolkitScope)
+	if err != nil {
+		return nil, err
+	}
+	return conf.Client(ctx), nil
+}
+
+// setAccountInfo calls the setAccountInfo API directly.
+func (c *retryingClient) setAccountInfo(ctx context.Context, req *setAccountInfoRequest) error {
+	if dryRun {
+		return printDryRun("setAccountInfo", req)
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return c.policy.do(ctx, "setAccountInfo", func(ctx context.Context) error {
+		hreq, err := http.NewRequest("POST", setAccountInfoURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		hreq.Header.Set("Content-Type", "application/json")
+		resp, err := c.hc.Do(hreq.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+		var e struct {
+			Error struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if b, err := ioutil.ReadAll(resp.Body); err != nil || json.Unmarshal(b, &e) != nil || e.Error.Code == 0 {
+			return &gitkit.APIError{Code: resp.StatusCode, Message: fmt.Sprintf("setAccountInfo failed: %s", resp.Status)}
+		}
+		return &gitkit.APIError{Code: e.Error.Code, Message: e.Error.Message}
+	})
+}
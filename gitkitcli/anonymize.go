@@ -0,0 +1,253 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+// Names the fake users are made of.
+var (
+	fakeFirstNames = []string{
+		"alex", "blake", "casey", "dana", "drew", "eli", "emery", "finley", "harper", "jamie",
+		"jesse", "jordan", "kai", "kendall", "logan", "morgan", "parker", "quinn", "reese", "riley",
+		"robin", "rowan", "sage", "sam", "skyler", "taylor",
+	}
+	fakeLastNames = []string{
+		"adams", "baker", "brooks", "carter", "collins", "cooper", "davis", "ellis", "foster", "gray",
+		"hayes", "hughes", "jensen", "kelly", "lee", "morris", "nguyen", "parker", "price", "reed",
+		"rivera", "shaw", "turner", "walsh", "ward", "young",
+	}
+)
+
+// anonymizer replaces the personal data of the users with fake values. The
+// same input value is always replaced by the same fake value for a given
+// seed.
+type anonymizer struct {
+	seed []byte
+	// Whether the email domains are kept instead of being replaced.
+	keepDomains bool
+	algorithm   string
+	key         []byte
+	password    string
+
+	// Fake email addresses and domains by the lowercased input ones, and the
+	// fake addresses in use.
+	emails  map[string]string
+	domains map[string]string
+	used    map[string]bool
+}
+
+func newAnonymizer(seed []byte) *anonymizer {
+	return &anonymizer{
+		seed:    seed,
+		emails:  make(map[string]string),
+		domains: make(map[string]string),
+		used:    make(map[string]bool),
+	}
+}
+
+// sum returns the keyed hash of the value, so that the fake values cannot be
+// traced back to the input without the seed.
+func (a *anonymizer) sum(kind, value string) []byte {
+	mac := hmac.New(sha256.New, a.seed)
+	mac.Write([]byte(kind + ":" + value))
+	return mac.Sum(nil)
+}
+
+// fakeName returns the fake first and last names derived from the hash.
+func fakeName(sum []byte) (string, string) {
+	n := binary.BigEndian.Uint32(sum)
+	return fakeFirstNames[n%uint32(len(fakeFirstNames))], fakeLastNames[n/uint32(len(fakeFirstNames))%uint32(len(fakeLastNames))]
+}
+
+// domain returns the fake domain of the input domain. All users of a domain
+// are given the same fake domain, so that the distribution of the domains is
+// kept.
+func (a *anonymizer) domain(domain string) string {
+	if a.keepDomains {
+		return domain
+	}
+	d, ok := a.domains[domain]
+	if !ok {
+		d = fmt.Sprintf("d%s.example.test", hex.EncodeToString(a.sum("domain", domain)[:4]))
+		a.domains[domain] = d
+	}
+	return d
+}
+
+// email returns the fake email address of the input one.
+func (a *anonymizer) email(email string) string {
+	email = strings.ToLower(email)
+	if fake, ok := a.emails[email]; ok {
+		return fake
+	}
+	domain := ""
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		domain = a.domain(email[i+1:])
+	}
+	sum := a.sum("email", email)
+	first, last := fakeName(sum)
+	fake := fmt.Sprintf("%s.%s.%04d@%s", first, last, binary.BigEndian.Uint16(sum[4:])%10000, domain)
+	// Fake addresses which collide are made unique by a suffix.
+	for i := 2; a.used[fake]; i++ {
+		fake = fmt.Sprintf("%s.%s.%04d.%d@%s", first, last, binary.BigEndian.Uint16(sum[4:])%10000, i, domain)
+	}
+	a.emails[email] = fake
+	a.used[fake] = true
+	return fake
+}
+
+// anonymize returns the anonymized copy of the user. The email verification,
+// disabled flag and timestamps are kept, as is whether the user has a
+// display name and a password.
+func (a *anonymizer) anonymize(u *gitkit.User) (*gitkit.User, error) {
+	v := &gitkit.User{
+		EmailVerified:    u.EmailVerified,
+		Disabled:         u.Disabled,
+		Version:          u.Version,
+		PasswordUpdateAt: u.PasswordUpdateAt,
+		ValidSince:       u.ValidSince,
+	}
+	if u.LocalID != "" {
+		v.LocalID = hex.EncodeToString(a.sum("localId", u.LocalID)[:16])
+	}
+	if u.Email != "" {
+		v.Email = a.email(u.Email)
+	}
+	if u.DisplayName != "" {
+		// The name matches the email address if there is one.
+		key := strings.ToLower(u.Email)
+		if key == "" {
+			key = u.LocalID
+		}
+		first, last := fakeName(a.sum("email", key))
+		v.DisplayName = strings.ToUpper(first[:1]) + first[1:] + " " + strings.ToUpper(last[:1]) + last[1:]
+	}
+	if len(u.PasswordHash) > 0 {
+		salt, err := randomBytes(10)
+		if err != nil {
+			return nil, err
+		}
+		if v.PasswordHash, err = hashPassword(a.algorithm, a.password, salt, a.key); err != nil {
+			return nil, err
+		}
+		v.Salt = salt
+	}
+	return v, nil
+}
+
+func commandAnonymize() cli.Command {
+	return cli.Command{
+		Name:  "anonymize",
+		Usage: "anonymize [Options] INPUT OUTPUT",
+		Description: "Write the users in the input file to the output file with fake email addresses, names and local IDs, " +
+			"for loading into a staging project. Provider links and photos are removed, and the password hashes are " +
+			"replaced by the hashes of the test password. If the output is -, standard output is used.",
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "seed",
+				Usage: "the secret from which the fake values are derived. The same seed gives the same fake values. Default to a random seed.",
+			},
+			cli.BoolFlag{
+				Name:  "keep_domains",
+				Usage: "keep the domains of the email addresses instead of replacing them with fake domains.",
+			},
+			cli.StringFlag{
+				Name:  "algorithm",
+				Value: "HMAC_SHA1",
+				Usage: "the algorithm name for hashing the test password.",
+			},
+			cli.StringFlag{
+				Name:  "hash_key",
+				Usage: "URL safe base64 encoded hash key for hashing the test password.",
+			},
+		}, passwordFlags()...),
+		Action: func(c *cli.Context) {
+			if n := len(c.Args()); n != 2 {
+				failOnError(c, argError("except 2 arguments but got %d", n))
+			}
+			if !c.IsSet("hash_key") {
+				failOnError(c, argError("-hash_key is required"))
+			}
+			seed := []byte(c.String("seed"))
+			if !c.IsSet("seed") {
+				var err error
+				seed, err = randomBytes(32)
+				failOnError(c, err)
+			}
+			a := newAnonymizer(seed)
+			a.keepDomains = c.Bool("keep_domains")
+			a.algorithm = c.String("algorithm")
+			var err error
+			a.key, err = base64.URLEncoding.DecodeString(c.String("hash_key"))
+			failOnError(c, err)
+			// Fail early if the algorithm cannot be computed locally.
+			_, err = hashPassword(a.algorithm, "", nil, a.key)
+			failOnError(c, err)
+			a.password, err = readPassword(c, "Test password: ")
+			failOnError(c, err)
+			in, size, err := openUsers(c.Args().Get(0))
+			failOnError(c, err)
+			defer in.Close()
+			var out *os.File
+			if c.Args().Get(1) == "-" {
+				out = os.Stdout
+			} else {
+				out, err = os.OpenFile(c.Args().Get(1), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, os.FileMode(0600))
+				failOnError(c, err)
+				defer out.Close()
+			}
+			cr := &countingReader{r: in}
+			r := jsonUserReader(json.NewDecoder(cr))
+			p := newProgress(c.Command.Name, cr, size)
+			n := 0
+			for {
+				if ctx.Err() != nil {
+					p.finish()
+					failOnError(c, ctx.Err())
+				}
+				rec, err := r()
+				if err == io.EOF {
+					break
+				}
+				failOnError(c, err)
+				u, err := a.anonymize(rec.User)
+				failOnError(c, err)
+				b, err := json.MarshalIndent(u, "", "  ")
+				failOnError(c, err)
+				_, err = fmt.Fprintln(out, string(b))
+				failOnError(c, err)
+				n++
+				p.add(1, 0)
+			}
+			p.finish()
+			fmt.Fprintf(os.Stderr, ">> %d users anonymized\n", n)
+			fmt.Fprintln(os.Stderr, ">> done")
+		},
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+// passwordHashers computes the password hashes of the algorithms which can be
+// verified locally. The HMAC algorithms hash the password followed by the
+// salt with the key, as generateUser does.
+var passwordHashers = map[string]func(password, salt, key []byte) []byte{
+	"HMAC_SHA1":   hmacHasher(sha1.New),
+	"HMAC_SHA256": hmacHasher(sha256.New),
+	"HMAC_SHA512": hmacHasher(sha512.New),
+	"HMAC_MD5":    hmacHasher(md5.New),
+}
+
+func hmacHasher(h func() hash.Hash) func(password, salt, key []byte) []byte {
+	return func(password, salt, key []byte) []byte {
+		mac := hmac.New(h, key)
+		mac.Write(password)
+		mac.Write(salt)
+		return mac.Sum(nil)
+	}
+}
+
+// hashPassword hashes the password with the algorithm.
+func hashPassword(algorithm, password string, salt, key []byte) ([]byte, error) {
+	h, ok := passwordHashers[algorithm]
+	if !ok {
+		var names []string
+		for name := range passwordHashers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, argError("cannot verify algorithm %s locally, supported algorithms: %s", algorithm, strings.Join(names, ", "))
+	}
+	return h([]byte(password), salt, key), nil
+}
+
+// findUserInFile returns the user in the users file with the email address or
+// local ID, or the first user if identifier is empty. The hash algorithm of
+// the record is also returned if it has one.
+func findUserInFile(path, identifier string) (*gitkit.User, string, error) {
+	f, _, err := openUsers(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	r := jsonUserReader(json.NewDecoder(f))
+	for {
+		rec, err := r()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		if identifier == "" || rec.LocalID == identifier || strings.EqualFold(rec.Email, identifier) {
+			return rec.User, rec.HashAlgorithm, nil
+		}
+	}
+	if identifier == "" {
+		return nil, "", argError("no user in %s", path)
+	}
+	return nil, "", &cliError{exitUserNotFound, fmt.Errorf("user %s not found in %s", identifier, path)}
+}
+
+func commandCheckPassword() cli.Command {
+	return cli.Command{
+		Name:  "checkpassword",
+		Usage: "checkpassword [Options] USERS_FILE|EMAIL|LOCAL_ID",
+		Description: "Check a password against the password hash of the user, in the users file or fetched from the server. " +
+			"The password is prompted to enter unless given by the options, and hashed locally.",
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "user",
+				Usage: "the email address or local ID of the user in the users file. Default to the first user.",
+			},
+			cli.StringFlag{
+				Name:  "algorithm",
+				Usage: "the algorithm name for hashing password. Default to the hashAlgorithm of the record, or HMAC_SHA1.",
+			},
+			cli.StringFlag{
+				Name:  "hash_key",
+				Usage: "URL safe base64 encoded hash key.",
+			},
+		}, passwordFlags()...),
+		Action: func(c *cli.Context) {
+			failOnError(c, checkOneArgument(c))
+			if !c.IsSet("hash_key") {
+				failOnError(c, argError("-hash_key is required"))
+			}
+			key, err := base64.URLEncoding.DecodeString(c.String("hash_key"))
+			failOnError(c, err)
+			var u *gitkit.User
+			algorithm := c.String("algorithm")
+			arg := c.Args().First()
+			if _, err := os.Stat(arg); err == nil || arg == "-" {
+				var recAlgorithm string
+				u, recAlgorithm, err = findUserInFile(arg, c.String("user"))
+				failOnError(c, err)
+				if algorithm == "" {
+					algorithm = recAlgorithm
+				}
+			} else {
+				// The client is only needed to fetch the user.
+				failOnError(c, initClient(c))
+				u, err = getUserByIdentifier(arg)
+				failOnError(c, err)
+			}
+			if algorithm == "" {
+				algorithm = "HMAC_SHA1"
+			}
+			if len(u.PasswordHash) == 0 {
+				failOnError(c, argError("user %s has no password hash", u.Email))
+			}
+			password, err := readPassword(c, "Password: ")
+			failOnError(c, err)
+			h, err := hashPassword(algorithm, password, u.Salt, key)
+			failOnError(c, err)
+			if !hmac.Equal(h, u.PasswordHash) {
+				failOnError(c, fmt.Errorf("password does not match the %s hash of user %s", algorithm, u.Email))
+			}
+			fmt.Printf(">> password matches the %s hash of user %s\n", algorithm, u.Email)
+		},
+	}
+}
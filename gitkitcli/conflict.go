@@ -0,0 +1,148 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+// Conflict policies for uploading a user whose email address or local ID is
+// already used by an existing account.
+const (
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+	conflictMerge     = "merge"
+	conflictFail      = "fail"
+)
+
+// Fields which can be merged, in the names of their JSON keys. The password
+// hash is not one of them, see mergeUser.
+var mergeFields = []string{
+	"email",
+	"emailVerified",
+	"displayName",
+	"photoUrl",
+	"disabled",
+	"providerUserInfo",
+}
+
+// findExisting returns the existing account of the client with the same
+// email address as the user, or with the same local ID if byLocalID is set.
+// nil is returned if there is no such account.
+func findExisting(c *retryingClient, u *gitkit.User, byLocalID bool) (*gitkit.User, error) {
+	if u.Email != "" {
+		existing, err := lookupUser(c.UserByEmail(ctx, u.Email))
+		if existing != nil || err != nil {
+			return existing, err
+		}
+	}
+	if byLocalID && u.LocalID != "" {
+		return lookupUser(c.UserByLocalID(ctx, u.LocalID))
+	}
+	return nil, nil
+}
+
+// parseMergePriority parses the comma separated fields in which the uploaded
+// value takes priority over the existing one. All fields are returned if the
+// list is empty.
+func parseMergePriority(list string) (map[string]bool, error) {
+	priority := make(map[string]bool)
+	if list == "" {
+		for _, f := range mergeFields {
+			priority[f] = true
+		}
+		return priority, nil
+	}
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		known := false
+		for _, m := range mergeFields {
+			known = known || m == f
+		}
+		if !known {
+			return nil, argError("unknown field %s, expect one of %s", f, strings.Join(mergeFields, ", "))
+		}
+		priority[f] = true
+	}
+	return priority, nil
+}
+
+// mergeUser merges the uploaded user into the existing one. For the fields in
+// priority, the uploaded value is used unless it is empty. For the other
+// fields, the existing value is kept unless it is empty. The password hash and
+// salt are always the uploaded ones, if any: the existing ones were made with
+// the hash options of the project, not those of the upload, so the user could
+// no longer sign in with them.
+func mergeUser(existing, u *gitkit.User, priority map[string]bool) *gitkit.User {
+	m := *existing
+	// pick reports whether the uploaded value of the field should be used.
+	pick := func(field string, uploadedEmpty, existingEmpty bool) bool {
+		if priority[field] {
+			return !uploadedEmpty
+		}
+		return existingEmpty && !uploadedEmpty
+	}
+	if pick("email", u.Email == "", m.Email == "") {
+		m.Email = u.Email
+	}
+	if pick("emailVerified", !u.EmailVerified, !m.EmailVerified) {
+		m.EmailVerified = u.EmailVerified
+	}
+	if pick("displayName", u.DisplayName == "", m.DisplayName == "") {
+		m.DisplayName = u.DisplayName
+	}
+	if pick("photoUrl", u.PhotoURL == "", m.PhotoURL == "") {
+		m.PhotoURL = u.PhotoURL
+	}
+	m.PasswordHash, m.Salt = nil, nil
+	if len(u.PasswordHash) > 0 {
+		m.PasswordHash, m.Salt = u.PasswordHash, u.Salt
+	}
+	if pick("disabled", !u.Disabled, !m.Disabled) {
+		m.Disabled = u.Disabled
+	}
+	if pick("providerUserInfo", len(u.ProviderUserInfo) == 0, len(m.ProviderUserInfo) == 0) {
+		m.ProviderUserInfo = u.ProviderUserInfo
+	}
+	return &m
+}
+
+// resolveConflict applies the conflict policy to the user to upload. It
+// returns the user to upload, or nil if it is skipped, and the action taken.
+func resolveConflict(c *retryingClient, u *gitkit.User, policy string, priority map[string]bool) (*gitkit.User, string, error) {
+	existing, err := findExisting(c, u, true)
+	if err != nil {
+		return nil, "", err
+	}
+	if existing == nil {
+		return u, "created", nil
+	}
+	switch policy {
+	case conflictSkip:
+		return nil, "skipped", nil
+	case conflictFail:
+		return nil, "", &cliError{exitGeneral, fmt.Errorf("user %s already exists as %s", u.Email, existing.LocalID)}
+	case conflictMerge:
+		return mergeUser(existing, u, priority), "merged", nil
+	}
+	// Overwrite the existing account, which may have a different local ID if
+	// it is found by email address.
+	o := *u
+	o.LocalID = existing.LocalID
+	return &o, "overwritten", nil
+}
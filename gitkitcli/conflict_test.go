@@ -0,0 +1,129 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+func TestMergeUser(t *testing.T) {
+	existing := &gitkit.User{
+		LocalID:      "existing",
+		Email:        "old@example.com",
+		DisplayName:  "Old Name",
+		PasswordHash: []byte("old hash"),
+		Salt:         []byte("old salt"),
+		ProviderUserInfo: []*gitkit.ProviderUserInfo{
+			{ProviderID: "google.com", FederatedID: "123"},
+		},
+	}
+	tests := []struct {
+		name     string
+		uploaded *gitkit.User
+		priority string
+		want     *gitkit.User
+	}{
+		{
+			name: "uploaded values win in priority fields",
+			uploaded: &gitkit.User{
+				LocalID:       "uploaded",
+				Email:         "new@example.com",
+				EmailVerified: true,
+				DisplayName:   "New Name",
+				PhotoURL:      "https://example.com/new.png",
+				PasswordHash:  []byte("new hash"),
+				Salt:          []byte("new salt"),
+			},
+			priority: "",
+			want: &gitkit.User{
+				LocalID:       "existing",
+				Email:         "new@example.com",
+				EmailVerified: true,
+				DisplayName:   "New Name",
+				PhotoURL:      "https://example.com/new.png",
+				PasswordHash:  []byte("new hash"),
+				Salt:          []byte("new salt"),
+				ProviderUserInfo: []*gitkit.ProviderUserInfo{
+					{ProviderID: "google.com", FederatedID: "123"},
+				},
+			},
+		},
+		{
+			name: "existing values are kept in other fields unless empty",
+			uploaded: &gitkit.User{
+				Email:        "new@example.com",
+				DisplayName:  "New Name",
+				PhotoURL:     "https://example.com/new.png",
+				PasswordHash: []byte("new hash"),
+				Salt:         []byte("new salt"),
+			},
+			priority: "emailVerified",
+			want: &gitkit.User{
+				LocalID:      "existing",
+				Email:        "old@example.com",
+				DisplayName:  "Old Name",
+				PhotoURL:     "https://example.com/new.png",
+				PasswordHash: []byte("new hash"),
+				Salt:         []byte("new salt"),
+				ProviderUserInfo: []*gitkit.ProviderUserInfo{
+					{ProviderID: "google.com", FederatedID: "123"},
+				},
+			},
+		},
+		{
+			name: "empty uploaded values do not win in priority fields",
+			uploaded: &gitkit.User{
+				DisplayName: "New Name",
+			},
+			priority: "email,displayName,providerUserInfo",
+			want: &gitkit.User{
+				LocalID:     "existing",
+				Email:       "old@example.com",
+				DisplayName: "New Name",
+				ProviderUserInfo: []*gitkit.ProviderUserInfo{
+					{ProviderID: "google.com", FederatedID: "123"},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		priority, err := parseMergePriority(tt.priority)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if got := mergeUser(existing, tt.uploaded, priority); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: mergeUser() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	if existing.Email != "old@example.com" || string(existing.PasswordHash) != "old hash" {
+		t.Errorf("mergeUser() modified the existing user: %+v", existing)
+	}
+}
+
+func TestParseMergePriority(t *testing.T) {
+	if _, err := parseMergePriority("email,passwordHash"); err == nil {
+		t.Error("parseMergePriority() accepted passwordHash, which is not merged by priority")
+	}
+	p, err := parseMergePriority(" email , disabled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{"email": true, "disabled": true}; !reflect.DeepEqual(p, want) {
+		t.Errorf("parseMergePriority() = %v, want %v", p, want)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/codegangsta/cli"
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+// userFilter selects the users to copy.
+type userFilter struct {
+	domains      []string
+	verifiedOnly bool
+	skipDisabled bool
+}
+
+func (f *userFilter) match(u *gitkit.User) bool {
+	if f.verifiedOnly && !u.EmailVerified {
+		return false
+	}
+	if f.skipDisabled && u.Disabled {
+		return false
+	}
+	if len(f.domains) == 0 {
+		return true
+	}
+	email := strings.ToLower(u.Email)
+	for _, d := range f.domains {
+		if strings.HasSuffix(email, "@"+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyRecord is a row of the mapping report.
+type copyRecord struct {
+	oldID, newID, email, action string
+}
+
+func commandCopyUsers() cli.Command {
+	return cli.Command{
+		Name:  "copyusers",
+		Usage: "copyusers --from_profile PROFILE --to_profile PROFILE [Options]",
+		Description: "Copy the user accounts from one project to another. The projects are given by the profiles " +
+			"in the config file. The hash options are those of the source project.",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "from_profile",
+				Usage: "the profile of the source project.",
+			},
+			cli.StringFlag{
+				Name:  "to_profile",
+				Usage: "the profile of the destination project.",
+			},
+			cli.StringFlag{
+				Name:  "algorithm",
+				Usage: "the algorithm name for hashing password in the source project.",
+			},
+			cli.StringFlag{
+				Name:  "hash_key",
+				Usage: "URL safe base64 encoded hash key of the source project.",
+			},
+			cli.StringFlag{
+				Name:  "salt_separator",
+				Usage: "URL safe base64 encoded salt separator of the source project.",
+			},
+			cli.StringFlag{
+				Name:  "email_domains",
+				Usage: "comma separated email domains. Only the users in these domains are copied.",
+			},
+			cli.BoolFlag{
+				Name:  "verified_only",
+				Usage: "only copy the users whose email address is verified.",
+			},
+			cli.BoolFlag{
+				Name:  "skip_disabled",
+				Usage: "do not copy the disabled users.",
+			},
+			localIDStrategyFlag("from-field"),
+			cli.StringFlag{
+				Name:  "on_conflict",
+				Value: conflictFail,
+				Usage: "what to do if the user already exists in the destination project: skip, overwrite or fail.",
+			},
+			cli.StringFlag{
+				Name:  "mapping_report",
+				Usage: "the CSV file to write the old and new local IDs of the users and the action taken to.",
+			},
+		},
+		Action: func(c *cli.Context) {
+			failOnError(c, checkZeroArgument(c))
+			if !c.IsSet("from_profile") || !c.IsSet("to_profile") {
+				failOnError(c, argError("-from_profile and -to_profile are required"))
+			}
+			if !c.IsSet("algorithm") || !c.IsSet("hash_key") {
+				failOnError(c, argError("-algorithm and -hash_key are required"))
+			}
+			onConflict := c.String("on_conflict")
+			if onConflict != conflictSkip && onConflict != conflictOverwrite && onConflict != conflictFail {
+				failOnError(c, argError("-on_conflict must be skip, overwrite or fail"))
+			}
+			key, err := base64.URLEncoding.DecodeString(c.String("hash_key"))
+			failOnError(c, err)
+			separator, err := base64.URLEncoding.DecodeString(c.String("salt_separator"))
+			failOnError(c, err)
+			from, err := profileClient(c.String("from_profile"))
+			failOnError(c, err)
+			to, err := profileClient(c.String("to_profile"))
+			failOnError(c, err)
+			g, err := newLocalIDGenerator(c.String("local_id_strategy"), to)
+			failOnError(c, err)
+			filter := &userFilter{
+				verifiedOnly: c.Bool("verified_only"),
+				skipDisabled: c.Bool("skip_disabled"),
+			}
+			if c.IsSet("email_domains") {
+				for _, d := range strings.Split(c.String("email_domains"), ",") {
+					filter.domains = append(filter.domains, strings.ToLower(strings.TrimSpace(d)))
+				}
+			}
+			var report *csv.Writer
+			if c.IsSet("mapping_report") {
+				f, err := os.OpenFile(c.String("mapping_report"), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, os.FileMode(0600))
+				failOnError(c, err)
+				defer f.Close()
+				report = csv.NewWriter(f)
+				report.Write([]string{"old_local_id", "new_local_id", "email", "action"})
+			}
+			counts := make(map[string]int)
+			record := func(r *copyRecord) {
+				counts[r.action]++
+				if report != nil {
+					report.Write([]string{r.oldID, r.newID, r.email, reportedAction(r.action)})
+				}
+			}
+			p := newProgress(c.Command.Name, nil, 0)
+			var users []*gitkit.User
+			var records []*copyRecord
+			upload := func() error {
+				if len(users) == 0 {
+					return nil
+				}
+				// The batch in flight is not canceled on interruption.
+				err := to.UploadUsers(context.Background(), users, c.String("algorithm"), key, separator)
+				if uploadErr, ok := err.(gitkit.UploadError); ok {
+					for _, v := range uploadErr {
+						p.printf(">> failed to copy user %s: %s\n", users[v.Index].Email, v.Message)
+						records[v.Index].action = "failed"
+					}
+				} else if err != nil {
+					return err
+				}
+				for _, r := range records {
+					record(r)
+				}
+				users, records = nil, nil
+				return nil
+			}
+			err = from.listUsers(ctx, func(u *gitkit.User) error {
+				p.add(1, 0)
+				if !filter.match(u) {
+					return nil
+				}
+				r := &copyRecord{oldID: u.LocalID, email: u.Email}
+				existing, err := findExisting(to, u, g.strategy == "from-field")
+				if err != nil {
+					return err
+				}
+				if existing != nil {
+					switch onConflict {
+					case conflictFail:
+						return &cliError{exitGeneral, fmt.Errorf("user %s already exists in the destination project as %s", u.Email, existing.LocalID)}
+					case conflictSkip:
+						r.newID, r.action = existing.LocalID, "skipped"
+						record(r)
+						return nil
+					}
+					u.LocalID, r.action = existing.LocalID, "overwritten"
+				} else {
+					if err := g.assign(u); err != nil {
+						if exitCode(err) != exitInvalidArgument {
+							return err
+						}
+						p.printf(">> rejected user %s: %s\n", u.Email, err)
+						r.action = "rejected"
+						record(r)
+						return nil
+					}
+					r.action = "copied"
+				}
+				r.newID = u.LocalID
+				users = append(users, u)
+				records = append(records, r)
+				if len(users) < 20 {
+					return nil
+				}
+				return upload()
+			})
+			if err == nil {
+				err = upload()
+			}
+			p.finish()
+			// The report is flushed before exiting on failure, so that it
+			// covers the users copied so far.
+			if report != nil {
+				report.Flush()
+			}
+			fmt.Printf(">> %d %s, %d %s, %d skipped, %d rejected, %d failed\n",
+				counts["copied"], wouldBe("copied"), counts["overwritten"], wouldBe("overwritten"),
+				counts["skipped"], counts["rejected"], counts["failed"])
+			failOnError(c, err)
+			fmt.Println(">> done")
+			if n := counts["rejected"] + counts["failed"]; n > 0 {
+				failOnError(c, &cliError{exitPartialUpload, fmt.Errorf("failed to copy %d users", n)})
+			}
+		},
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpDebug is the transport logging the HTTP traffic of the clients, or nil
+// if it is not logged.
+var httpDebug *debugTransport
+
+// Headers whose values are masked.
+var secretHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+	"Set-Cookie":    true,
+}
+
+// redactURL masks the secret query parameters of the URL, including the API
+// key.
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	for k := range q {
+		if secretFields[k] || k == "key" {
+			q.Set(k, maskedValue)
+		}
+	}
+	r := *u
+	r.RawQuery = q.Encode()
+	return r.String()
+}
+
+// redactBody masks the secrets of a JSON or form encoded body. Other bodies
+// are returned as is.
+func redactBody(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err == nil {
+		if b, err := json.Marshal(maskSecrets(v)); err == nil {
+			return string(b)
+		}
+	}
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		if form, err := url.ParseQuery(string(body)); err == nil {
+			for k := range form {
+				if secretFields[k] {
+					form.Set(k, maskedValue)
+				}
+			}
+			return form.Encode()
+		}
+	}
+	return string(body)
+}
+
+// readBody reads the response body and replaces it with a copy for the
+// caller.
+func readBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil {
+		return nil, nil
+	}
+	b, err := ioutil.ReadAll(*body)
+	(*body).Close()
+	*body = ioutil.NopCloser(bytes.NewReader(b))
+	return b, err
+}
+
+// debugTransport logs the requests and responses with the secrets redacted,
+// and records them in a HAR file if harPath is set.
+type debugTransport struct {
+	base    http.RoundTripper
+	harPath string
+
+	mu  sync.Mutex
+	har harLog
+}
+
+func newDebugTransport(harPath string) *debugTransport {
+	t := &debugTransport{base: http.DefaultTransport, harPath: harPath}
+	t.har.Log.Version = "1.2"
+	t.har.Log.Creator = harCreator{Name: "gitkitcli", Version: "0.1"}
+	t.har.Log.Entries = []*harEntry{}
+	return t
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		// The request of the caller must not be modified, so a copy with
+		// the read body is sent.
+		reqBody = b
+		req = req.Clone(req.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	}
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	latency := time.Since(start)
+	u := redactURL(req.URL)
+	reqText := redactBody(req.Header.Get("Content-Type"), reqBody)
+	if err != nil {
+		log.Printf("HTTP %s %s failed after %s: %s\n  request: %s", req.Method, u, latency, err, reqText)
+		return nil, err
+	}
+	respBody, err := readBody(&resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	respText := redactBody(resp.Header.Get("Content-Type"), respBody)
+	log.Printf("HTTP %s %s %d in %s\n  request: %s\n  response: %s", req.Method, u, resp.StatusCode, latency, reqText, respText)
+	if t.harPath != "" {
+		var postData *harPostData
+		if len(reqBody) > 0 {
+			postData = &harPostData{MimeType: req.Header.Get("Content-Type"), Text: reqText}
+		}
+		t.record(&harEntry{
+			StartedDateTime: start.Format(time.RFC3339Nano),
+			Time:            latency.Seconds() * 1000,
+			Request: harRequest{
+				Method:      req.Method,
+				URL:         u,
+				HTTPVersion: req.Proto,
+				Headers:     harHeaders(req.Header),
+				QueryString: []harNameValue{},
+				PostData:    postData,
+				HeadersSize: -1,
+				BodySize:    len(reqBody),
+			},
+			Response: harResponse{
+				Status:      resp.StatusCode,
+				StatusText:  http.StatusText(resp.StatusCode),
+				HTTPVersion: resp.Proto,
+				Headers:     harHeaders(resp.Header),
+				Content:     harContent{Size: len(respBody), MimeType: resp.Header.Get("Content-Type"), Text: respText},
+				HeadersSize: -1,
+				BodySize:    len(respBody),
+			},
+			Cache:   struct{}{},
+			Timings: harTimings{Send: 0, Wait: latency.Seconds() * 1000, Receive: 0},
+		})
+	}
+	return resp, nil
+}
+
+// record adds the entry to the HAR log, which is written by writeHAR on exit.
+func (t *debugTransport) record(e *harEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.har.Log.Entries = append(t.har.Log.Entries, e)
+}
+
+// writeHAR writes the recorded requests to the HAR file, if one is set. It is
+// called once when the program exits.
+func writeHAR() {
+	if httpDebug == nil || httpDebug.harPath == "" {
+		return
+	}
+	t := httpDebug
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, err := json.MarshalIndent(&t.har, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(t.harPath, b, 0600)
+	}
+	if err != nil {
+		log.Printf("Cannot write HAR file %s: %s", t.harPath, err)
+	}
+}
+
+// The HAR 1.2 format, see http://www.softwareishard.com/blog/har-12-spec/.
+type (
+	harLog struct {
+		Log struct {
+			Version string      `json:"version"`
+			Creator harCreator  `json:"creator"`
+			Entries []*harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	harCreator struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	harEntry struct {
+		StartedDateTime string      `json:"startedDateTime"`
+		Time            float64     `json:"time"`
+		Request         harRequest  `json:"request"`
+		Response        harResponse `json:"response"`
+		Cache           struct{}    `json:"cache"`
+		Timings         harTimings  `json:"timings"`
+	}
+	harRequest struct {
+		Method      string         `json:"method"`
+		URL         string         `json:"url"`
+		HTTPVersion string         `json:"httpVersion"`
+		Headers     []harNameValue `json:"headers"`
+		QueryString []harNameValue `json:"queryString"`
+		PostData    *harPostData   `json:"postData,omitempty"`
+		HeadersSize int            `json:"headersSize"`
+		BodySize    int            `json:"bodySize"`
+	}
+	harResponse struct {
+		Status      int            `json:"status"`
+		StatusText  string         `json:"statusText"`
+		HTTPVersion string         `json:"httpVersion"`
+		Headers     []harNameValue `json:"headers"`
+		Content     harContent     `json:"content"`
+		RedirectURL string         `json:"redirectURL"`
+		HeadersSize int            `json:"headersSize"`
+		BodySize    int            `json:"bodySize"`
+	}
+	harNameValue struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	harPostData struct {
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text"`
+	}
+	harContent struct {
+		Size     int    `json:"size"`
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text"`
+	}
+	harTimings struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	}
+)
+
+// harHeaders converts the headers with the secrets masked.
+func harHeaders(h http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			if secretHeaders[http.CanonicalHeaderKey(name)] {
+				v = maskedValue
+			}
+			headers = append(headers, harNameValue{name, v})
+		}
+	}
+	return headers
+}
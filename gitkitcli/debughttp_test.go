@@ -0,0 +1,86 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestMaskSecrets(t *testing.T) {
+	in := `{
+		"localId": "1234",
+		"password": "secret",
+		"salt": "",
+		"signerKey": null,
+		"users": [{"email": "a@example.com", "passwordHash": "aGFzaA=="}],
+		"nested": {"idToken": "eyJ", "displayName": "A"}
+	}`
+	want := `{
+		"localId": "1234",
+		"password": "REDACTED",
+		"salt": "",
+		"signerKey": null,
+		"users": [{"email": "a@example.com", "passwordHash": "REDACTED"}],
+		"nested": {"idToken": "REDACTED", "displayName": "A"}
+	}`
+	var v, w interface{}
+	if err := json.Unmarshal([]byte(in), &v); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	if got := maskSecrets(v); !reflect.DeepEqual(got, w) {
+		t.Errorf("maskSecrets() = %v, want %v", got, w)
+	}
+	// The input is not modified.
+	if m := v.(map[string]interface{}); m["password"] != "secret" {
+		t.Errorf("maskSecrets() modified its input: password = %v", m["password"])
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        string
+	}{
+		{"application/json", "", ""},
+		{"application/json", `{"email":"a@example.com","newPassword":"secret"}`, `{"email":"a@example.com","newPassword":"REDACTED"}`},
+		{"application/json; charset=UTF-8", `[{"oobCode":"abc"}]`, `[{"oobCode":"REDACTED"}]`},
+		{"application/x-www-form-urlencoded", "assertion=eyJ&grant_type=jwt-bearer", "assertion=REDACTED&grant_type=jwt-bearer"},
+		{"text/plain", "password=secret", "password=secret"},
+		{"application/json", "not json", "not json"},
+	}
+	for _, tt := range tests {
+		if got := redactBody(tt.contentType, []byte(tt.body)); got != tt.want {
+			t.Errorf("redactBody(%q, %q) = %q, want %q", tt.contentType, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	u, err := url.Parse("https://www.googleapis.com/identitytoolkit/v3/relyingparty/getAccountInfo?key=AIza&alt=json&access_token=ya29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "https://www.googleapis.com/identitytoolkit/v3/relyingparty/getAccountInfo?access_token=REDACTED&alt=json&key=REDACTED"
+	if got := redactURL(u); got != want {
+		t.Errorf("redactURL() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+// userKey returns the key identifying the user, either its local ID or its
+// lowercased email address.
+func userKey(u *gitkit.User, byEmail bool) string {
+	if byEmail {
+		return strings.ToLower(u.Email)
+	}
+	return u.LocalID
+}
+
+// providerIDs returns the sorted provider and federated IDs of the user.
+func providerIDs(u *gitkit.User) string {
+	var ids []string
+	for _, p := range u.ProviderUserInfo {
+		ids = append(ids, p.ProviderID+":"+p.FederatedID)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+// diffUsers compares the fields of the expected user with the actual one and
+// describes each difference. Only the named fields are compared, or all of
+// them if fields is nil. The password hash and salt are only compared if they
+// are set in the expected user.
+func diffUsers(want, got *gitkit.User, fields map[string]bool) []string {
+	var diffs []string
+	compared := func(field string) bool {
+		return fields == nil || fields[field]
+	}
+	add := func(field string, want, got interface{}) {
+		diffs = append(diffs, fmt.Sprintf("%s: want %v, got %v", field, want, got))
+	}
+	if compared("localId") && want.LocalID != got.LocalID {
+		add("localId", want.LocalID, got.LocalID)
+	}
+	if compared("email") && !strings.EqualFold(want.Email, got.Email) {
+		add("email", want.Email, got.Email)
+	}
+	if compared("emailVerified") && want.EmailVerified != got.EmailVerified {
+		add("emailVerified", want.EmailVerified, got.EmailVerified)
+	}
+	if compared("displayName") && want.DisplayName != got.DisplayName {
+		add("displayName", want.DisplayName, got.DisplayName)
+	}
+	if compared("photoUrl") && want.PhotoURL != got.PhotoURL {
+		add("photoUrl", want.PhotoURL, got.PhotoURL)
+	}
+	if compared("disabled") && want.Disabled != got.Disabled {
+		add("disabled", want.Disabled, got.Disabled)
+	}
+	if w, g := providerIDs(want), providerIDs(got); compared("providers") && w != g {
+		add("providers", w, g)
+	}
+	if compared("passwordHash") && len(want.PasswordHash) > 0 && !bytes.Equal(want.PasswordHash, got.PasswordHash) {
+		diffs = append(diffs, "passwordHash differs")
+	}
+	if compared("salt") && len(want.Salt) > 0 && !bytes.Equal(want.Salt, got.Salt) {
+		diffs = append(diffs, "salt differs")
+	}
+	return diffs
+}
+
+// loadUsers reads all the users in the file into a map by their key.
+func loadUsers(path string, byEmail bool) (map[string]*gitkit.User, error) {
+	f, _, err := openUsers(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]*gitkit.User)
+	d := json.NewDecoder(f)
+	for {
+		var u gitkit.User
+		if err := d.Decode(&u); err == io.EOF {
+			return users, nil
+		} else if err != nil {
+			return nil, err
+		}
+		k := userKey(&u, byEmail)
+		if k == "" {
+			return nil, fmt.Errorf("user without key: %+v", u)
+		}
+		if _, ok := users[k]; ok {
+			return nil, fmt.Errorf("duplicated user %s", k)
+		}
+		users[k] = &u
+	}
+}
+
+func commandDiff() cli.Command {
+	return cli.Command{
+		Name:  "diff",
+		Usage: "diff [Options] SOURCE_FILE",
+		Description: "Compare the user accounts in the file with the live ones and report the missing, extra and " +
+			"differing users. The file has the same format as the one written by downloadusers.",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "by_email",
+				Usage: "match the users by email address instead of local ID.",
+			},
+			cli.StringFlag{
+				Name:  "fix",
+				Usage: "the file to write the missing and differing source users to, which can be passed to uploadusers.",
+			},
+		},
+		Action: func(c *cli.Context) {
+			failOnError(c, checkOneArgument(c))
+			byEmail := c.Bool("by_email")
+			src, err := loadUsers(c.Args().First(), byEmail)
+			failOnError(c, err)
+			var fix []*gitkit.User
+			extra, differing := 0, 0
+			p := newProgress(c.Command.Name, nil, 0)
+			err = client.listUsers(ctx, func(u *gitkit.User) error {
+				p.add(1, 0)
+				k := userKey(u, byEmail)
+				want, ok := src[k]
+				if !ok {
+					extra++
+					p.printf(">> extra user %s\n", k)
+					return nil
+				}
+				delete(src, k)
+				if diffs := diffUsers(want, u, nil); len(diffs) > 0 {
+					differing++
+					p.printf(">> differing user %s: %s\n", k, strings.Join(diffs, "; "))
+					fix = append(fix, want)
+				}
+				return nil
+			})
+			p.finish()
+			failOnError(c, err)
+			var missing []string
+			for k := range src {
+				missing = append(missing, k)
+			}
+			sort.Strings(missing)
+			for _, k := range missing {
+				fmt.Printf(">> missing user %s\n", k)
+				fix = append(fix, src[k])
+			}
+			fmt.Printf(">> %d missing, %d extra, %d differing users\n", len(missing), extra, differing)
+			if c.IsSet("fix") {
+				f, err := os.OpenFile(c.String("fix"), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, os.FileMode(0600))
+				failOnError(c, err)
+				defer f.Close()
+				for _, u := range fix {
+					b, err := json.MarshalIndent(u, "", "  ")
+					failOnError(c, err)
+					_, err = fmt.Fprintln(f, string(b))
+					failOnError(c, err)
+				}
+				fmt.Printf(">> %d users written to %s\n", len(fix), c.String("fix"))
+			}
+			fmt.Println(">> done")
+		},
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+// Maximum difference tolerated between the local clock and the server's.
+const maxClockSkew = time.Minute
+
+// Token endpoint used for the clock check if the credentials do not name one.
+const defaultTokenURI = "https://accounts.google.com/o/oauth2/token"
+
+// clientIDPattern matches the OAuth2 client IDs of Google projects.
+var clientIDPattern = regexp.MustCompile(`^[0-9]+-[0-9a-z]+\.apps\.googleusercontent\.com$`)
+
+// checkConfigFile reads the config file strictly, reporting the position of
+// syntax errors and the unknown fields.
+func checkConfigFile(path string) (*CliConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	var config CliConfig
+	if err := d.Decode(&config); err != nil {
+		if se, ok := err.(*json.SyntaxError); ok {
+			line := 1 + bytes.Count(b[:se.Offset], []byte("\n"))
+			return nil, fmt.Errorf("line %d: %s", line, se)
+		}
+		return nil, err
+	}
+	for name, p := range config.Profiles {
+		if p == nil || p.GoogleAppCredentialsPath == "" {
+			return nil, fmt.Errorf("profile %s has no googleAppCredentialsPath", name)
+		}
+	}
+	return &config, nil
+}
+
+// serviceAccountKey is the JSON key file of a service account.
+type serviceAccountKey struct {
+	Type        string `json:"type"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// checkCredentials reads the service account key file and parses its private
+// key.
+func checkCredentials(path string) (*serviceAccountKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var key serviceAccountKey
+	if err := json.Unmarshal(b, &key); err != nil {
+		return nil, fmt.Errorf("not a JSON key file: %s", err)
+	}
+	if key.Type != "service_account" {
+		return nil, fmt.Errorf("type is %q, not service_account", key.Type)
+	}
+	if key.ClientEmail == "" {
+		return nil, errors.New("client_email is missing")
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, errors.New("private_key is not PEM encoded")
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("invalid private_key: %s", err)
+		}
+	}
+	return &key, nil
+}
+
+// serverClockSkew returns the difference between the local clock and the
+// Date header of the server's response.
+func serverClockSkew(url string) (time.Duration, error) {
+	hc := &http.Client{Timeout: 10 * time.Second}
+	start := time.Now()
+	resp, err := hc.Head(url)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("no Date header in the response of %s", url)
+	}
+	// The Date header has a resolution of one second, and is compared with
+	// the middle of the request.
+	local := start.Add(time.Since(start) / 2)
+	return local.Sub(date), nil
+}
+
+// tokenClockSkew returns how far the issue time of the ID token is in the
+// future of the local clock. The token is not verified.
+func tokenClockSkew(token string) (time.Duration, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, errors.New("not a JWT")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return 0, fmt.Errorf("invalid JWT payload: %s", err)
+	}
+	var claims struct {
+		IssuedAt int64 `json:"iat"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return 0, fmt.Errorf("invalid JWT payload: %s", err)
+	}
+	return time.Unix(claims.IssuedAt, 0).Sub(time.Now()), nil
+}
+
+// checklist prints the results of the checks.
+type checklist struct {
+	failed int
+}
+
+func (l *checklist) pass(name, detail string) {
+	fmt.Printf("[PASS] %s: %s\n", name, detail)
+}
+
+func (l *checklist) fail(name string, err error) {
+	fmt.Printf("[FAIL] %s: %s\n", name, err)
+	l.failed++
+}
+
+func (l *checklist) skip(name, reason string) {
+	fmt.Printf("[SKIP] %s: %s\n", name, reason)
+}
+
+func commandDoctor() cli.Command {
+	return cli.Command{
+		Name:  "doctor",
+		Usage: "doctor [Options]",
+		Description: "Check the configuration, the credentials, the local clock and the access to the API, " +
+			"and print the result of each check.",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "id_token",
+				Usage: "a freshly issued ID token whose issue time is compared with the local clock.",
+			},
+		},
+		Action: func(c *cli.Context) {
+			failOnError(c, checkZeroArgument(c))
+			l := &checklist{}
+			config := &CliConfig{}
+			if path := c.GlobalString("config_file"); path == "" {
+				l.skip("config file", "-config_file is not set")
+			} else if cf, err := checkConfigFile(path); err != nil {
+				l.fail("config file", fmt.Errorf("%s: %s", path, err))
+			} else {
+				l.pass("config file", fmt.Sprintf("%s is valid, %d profiles", path, len(cf.Profiles)))
+				config = cf
+			}
+			if c.GlobalIsSet("client_id") {
+				config.ClientID = c.GlobalString("client_id")
+			}
+			if c.GlobalIsSet("google_app_credentials_path") {
+				config.GoogleAppCredentialsPath = c.GlobalString("google_app_credentials_path")
+			}
+
+			tokenURI := defaultTokenURI
+			if config.GoogleAppCredentialsPath == "" {
+				l.skip("credentials", "no credentials file, the default credentials are used")
+			} else if key, err := checkCredentials(config.GoogleAppCredentialsPath); err != nil {
+				l.fail("credentials", fmt.Errorf("%s: %s", config.GoogleAppCredentialsPath, err))
+			} else {
+				l.pass("credentials", fmt.Sprintf("service account %s", key.ClientEmail))
+				if key.TokenURI != "" {
+					tokenURI = key.TokenURI
+				}
+			}
+
+			if config.ClientID == "" {
+				l.skip("client ID", "not set, only needed to validate tokens")
+			} else if !clientIDPattern.MatchString(config.ClientID) {
+				l.fail("client ID", fmt.Errorf("%q does not look like NUMBER-ID.apps.googleusercontent.com", config.ClientID))
+			} else {
+				l.pass("client ID", config.ClientID)
+			}
+
+			if skew, err := serverClockSkew(tokenURI); err != nil {
+				l.fail("clock", fmt.Errorf("cannot get the server time: %s", err))
+			} else if skew > maxClockSkew || skew < -maxClockSkew {
+				l.fail("clock", fmt.Errorf("the local clock is off by %s from the server's; tokens may be rejected", skew))
+			} else {
+				l.pass("clock", fmt.Sprintf("off by %s from the server's", skew))
+			}
+			if c.IsSet("id_token") {
+				if skew, err := tokenClockSkew(c.String("id_token")); err != nil {
+					l.fail("token clock", err)
+				} else if skew > maxClockSkew {
+					l.fail("token clock", fmt.Errorf("the token is issued %s in the future of the local clock", skew))
+				} else {
+					l.pass("token clock", "the token is not issued in the future of the local clock")
+				}
+			}
+
+			gc, err := newClient(&gitkit.Config{GoogleAppCredentialsPath: config.GoogleAppCredentialsPath})
+			if err != nil {
+				l.fail("API access", err)
+			} else if _, err := lookupUser(gc.UserByLocalID(ctx, "gitkitcli-doctor")); err != nil {
+				l.fail("API access", err)
+			} else {
+				l.pass("API access", "looked up a user")
+			}
+
+			if l.failed > 0 {
+				failOnError(c, fmt.Errorf("%d checks failed", l.failed))
+			}
+			fmt.Println(">> done")
+		},
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+// dryRun controls whether the UpdateUser, DeleteUser and UploadUsers calls
+// print their payload instead of being made.
+var dryRun bool
+
+// dryRunActions are the actions taken for a user which are reported as not
+// taken in dry run mode.
+var dryRunActions = map[string]string{
+	"created":     "would create",
+	"overwritten": "would overwrite",
+	"merged":      "would merge",
+	"copied":      "would copy",
+}
+
+// reportedAction returns the action taken for a user as reported, which is
+// only the action that would be taken in dry run mode.
+func reportedAction(action string) string {
+	if a, ok := dryRunActions[action]; ok && dryRun {
+		return a
+	}
+	return action
+}
+
+// wouldBe returns the past participle reporting how many users were changed,
+// e.g. "created", or "would be created" in dry run mode.
+func wouldBe(done string) string {
+	if dryRun {
+		return "would be " + done
+	}
+	return done
+}
+
+// Value replacing the secrets in the printed payloads and HTTP logs.
+const maskedValue = "REDACTED"
+
+// secretFields are the JSON fields and form parameters whose values are
+// masked.
+var secretFields = map[string]bool{
+	"password":      true,
+	"newPassword":   true,
+	"passwordHash":  true,
+	"salt":          true,
+	"signerKey":     true,
+	"saltSeparator": true,
+	"idToken":       true,
+	"oobCode":       true,
+	"access_token":  true,
+	"id_token":      true,
+	"refresh_token": true,
+	"assertion":     true,
+	"client_secret": true,
+}
+
+// maskSecrets returns a copy of the decoded JSON value with the non-empty
+// values of the secret fields masked.
+func maskSecrets(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			if secretFields[k] && v != nil && v != "" {
+				m[k] = maskedValue
+			} else {
+				m[k] = maskSecrets(v)
+			}
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(t))
+		for i, v := range t {
+			a[i] = maskSecrets(v)
+		}
+		return a
+	}
+	return v
+}
+
+// printDryRun prints the payload of the API call which is not made, with the
+// secrets masked. The payload is converted through its JSON encoding, as
+// sent to the API.
+func printDryRun(method string, payload interface{}) error {
+	return fprintDryRun(os.Stdout, method, payload)
+}
+
+// fprintDryRun is printDryRun writing to w.
+func fprintDryRun(w io.Writer, method string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if b, err = json.MarshalIndent(maskSecrets(v), "", "  "); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, ">> dry run, not calling %s with:\n%s\n", method, b)
+	return err
+}
+
+// uploadPayload is the payload of an UploadUsers call.
+type uploadPayload struct {
+	HashAlgorithm string         `json:"hashAlgorithm"`
+	SignerKey     []byte         `json:"signerKey,omitempty"`
+	SaltSeparator []byte         `json:"saltSeparator,omitempty"`
+	Users         []*gitkit.User `json:"users"`
+}
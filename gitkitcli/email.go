@@ -0,0 +1,57 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/mail"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"golang.org/x/net/idna"
+)
+
+// normalizeEmailsFlag is the option for normalizing the email addresses of
+// new users.
+var normalizeEmailsFlag = cli.BoolFlag{
+	Name: "normalize_emails",
+	Usage: "normalize the email addresses: trim whitespace and convert the domain to lowercase ASCII. " +
+		"Addresses which are not a plain user@domain are rejected.",
+}
+
+// normalizeEmail trims the email address and converts its domain to the
+// canonical lowercase ASCII form, with internationalized domain names encoded
+// in punycode. The local part is kept as is. It returns an invalid argument
+// error if the address is not a plain addr-spec, e.g. if it has a display
+// name, a comment or a quoted local part.
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return "", argError("invalid email address %q: %s", email, err)
+	}
+	if addr.Name != "" || addr.Address != email {
+		return "", argError("email address %q is not a plain address, it is parsed as %q", email, addr.Address)
+	}
+	i := strings.LastIndex(email, "@")
+	domain, err := idna.Lookup.ToASCII(email[i+1:])
+	if err != nil {
+		return "", argError("invalid domain of email address %q: %s", email, err)
+	}
+	normalized := email[:i+1] + strings.ToLower(domain)
+	if normalized != email {
+		logVerbose("Normalized email address %q to %s", email, normalized)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+// Exit codes of the command line tool. They are stable and can be relied on
+// by scripts.
+const (
+	exitOK              = 0
+	exitGeneral         = 1
+	exitInvalidArgument = 2
+	exitUserNotFound    = 3
+	exitAuth            = 4
+	exitQuota           = 5
+	exitPartialUpload   = 6
+	exitNetwork         = 7
+	exitInterrupted     = 130
+)
+
+// Error kinds reported in the JSON error output, indexed by exit code.
+var errorKinds = map[int]string{
+	exitGeneral:         "general",
+	exitInvalidArgument: "invalid_argument",
+	exitUserNotFound:    "user_not_found",
+	exitAuth:            "auth",
+	exitQuota:           "quota",
+	exitPartialUpload:   "partial_upload",
+	exitNetwork:         "network",
+	exitInterrupted:     "interrupted",
+}
+
+// errorFormat is the format of the error printed on failure, either text or
+// json.
+var errorFormat = "text"
+
+// cliError is an error with the exit code of the command line tool.
+type cliError struct {
+	code int
+	err  error
+}
+
+func (e *cliError) Error() string {
+	return e.err.Error()
+}
+
+// argError returns an invalid argument error.
+func argError(format string, a ...interface{}) error {
+	return &cliError{exitInvalidArgument, fmt.Errorf(format, a...)}
+}
+
+// authError wraps err as an authentication or credential failure.
+func authError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &cliError{exitAuth, err}
+}
+
+// clientNotFoundPattern matches the error returned by the user lookups of
+// gitkit.Client when getAccountInfo finds no user.
+var clientNotFoundPattern = regexp.MustCompile(`^user .* not found$`)
+
+// isNotFound reports whether the error means that the looked up user does not
+// exist.
+func isNotFound(err error) bool {
+	switch e := err.(type) {
+	case *cliError:
+		return e.code == exitUserNotFound
+	case *gitkit.APIError:
+		return strings.Contains(e.Message, "NOT_FOUND")
+	}
+	return clientNotFoundPattern.MatchString(err.Error())
+}
+
+// exitCode classifies the error and returns the corresponding exit code.
+func exitCode(err error) int {
+	if err == context.Canceled || ctx.Err() == context.Canceled {
+		return exitInterrupted
+	}
+	if err == context.DeadlineExceeded {
+		return exitNetwork
+	}
+	if isNotFound(err) {
+		return exitUserNotFound
+	}
+	switch e := err.(type) {
+	case *cliError:
+		return e.code
+	case gitkit.UploadError:
+		return exitPartialUpload
+	case *gitkit.APIError:
+		switch {
+		case e.Code == 401 || e.Code == 403:
+			return exitAuth
+		case e.Code == 429 || strings.Contains(e.Message, "QUOTA") || strings.Contains(e.Message, "RATE_LIMIT"):
+			return exitQuota
+		case e.Code == 400:
+			return exitInvalidArgument
+		}
+	case *url.Error:
+		if strings.Contains(e.Error(), "oauth2") {
+			return exitAuth
+		}
+		return exitNetwork
+	case net.Error:
+		return exitNetwork
+	}
+	if strings.HasPrefix(err.Error(), "oauth2:") {
+		return exitAuth
+	}
+	return exitGeneral
+}
+
+// jsonError is the error object printed with -error_format=json.
+type jsonError struct {
+	Command       string `json:"command,omitempty"`
+	ExitCode      int    `json:"exitCode"`
+	Kind          string `json:"kind"`
+	Message       string `json:"message"`
+	GitkitCode    int    `json:"gitkitCode,omitempty"`
+	GitkitMessage string `json:"gitkitMessage,omitempty"`
+}
+
+// exitWithError prints the error in the configured format and exits with the
+// exit code of the error.
+func exitWithError(command string, err error) {
+	writeHAR()
+	code := exitCode(err)
+	if errorFormat != "json" {
+		if command != "" {
+			fmt.Fprintf(os.Stderr, "Fail to execute command %s: %s\n", command, err)
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(code)
+	}
+	e := jsonError{
+		Command:  command,
+		ExitCode: code,
+		Kind:     errorKinds[code],
+		Message:  err.Error(),
+	}
+	if c, ok := err.(*cliError); ok {
+		err = c.err
+	}
+	if apiErr, ok := err.(*gitkit.APIError); ok {
+		e.GitkitCode = apiErr.Code
+		e.GitkitMessage = apiErr.Message
+	}
+	b, _ := json.Marshal(e)
+	fmt.Fprintln(os.Stderr, string(b))
+	os.Exit(code)
+}
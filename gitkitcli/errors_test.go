@@ -0,0 +1,62 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+func TestNotFound(t *testing.T) {
+	found := &gitkit.User{LocalID: "1234"}
+	tests := []struct {
+		err      error
+		notFound bool
+		code     int
+	}{
+		// Returned by gitkit.Client when getAccountInfo finds no user.
+		{fmt.Errorf("user %s not found", "a@example.com"), true, exitUserNotFound},
+		{fmt.Errorf("user %s not found", "1234"), true, exitUserNotFound},
+		{&gitkit.APIError{Code: 400, Message: "USER_NOT_FOUND"}, true, exitUserNotFound},
+		{&gitkit.APIError{Code: 400, Message: "EMAIL_NOT_FOUND"}, true, exitUserNotFound},
+		{&cliError{exitUserNotFound, errors.New("user 1234 not found in users.json")}, true, exitUserNotFound},
+		{&gitkit.APIError{Code: 400, Message: "INVALID_EMAIL"}, false, exitInvalidArgument},
+		{&gitkit.APIError{Code: 403, Message: "PERMISSION_DENIED"}, false, exitAuth},
+		{argError("user %s not found", "x"), false, exitInvalidArgument},
+		{errors.New("user a@example.com not found in the cache of the proxy"), false, exitGeneral},
+		{errors.New("unexpected end of JSON input"), false, exitGeneral},
+	}
+	for _, tt := range tests {
+		if got := isNotFound(tt.err); got != tt.notFound {
+			t.Errorf("isNotFound(%v) = %v, want %v", tt.err, got, tt.notFound)
+		}
+		if got := exitCode(tt.err); got != tt.code {
+			t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.code)
+		}
+		u, err := lookupUser(found, tt.err)
+		if tt.notFound && (u != nil || err != nil) {
+			t.Errorf("lookupUser(%v) = %v, %v, want nil, nil", tt.err, u, err)
+		}
+		if !tt.notFound && err != tt.err {
+			t.Errorf("lookupUser(%v) returned error %v, want %v", tt.err, err, tt.err)
+		}
+	}
+	if u, err := lookupUser(found, nil); u != found || err != nil {
+		t.Errorf("lookupUser(user, nil) = %v, %v, want the user", u, err)
+	}
+}
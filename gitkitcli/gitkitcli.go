@@ -15,24 +15,28 @@
 package main
 
 import (
-	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha1"
 	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"math/big"
+	"net/http"
 	"net/mail"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
 
 	"github.com/codegangsta/cli"
 	"github.com/google/identity-toolkit-go-client/gitkit"
-	"github.com/howeyc/gopass"
 )
 
 func main() {
@@ -55,78 +59,251 @@ func main() {
 			Name:  "google_app_credentials_path",
 			Usage: "the path of the JSON key file of the Google service account.",
 		},
+		cli.StringFlag{
+			Name:  "error_format",
+			Value: "text",
+			Usage: "the format of the error printed on failure: text or json.",
+		},
+		cli.IntFlag{
+			Name:  "retries",
+			Value: retry.attempts - 1,
+			Usage: "the maximum number of retries of a failed API call.",
+		},
+		cli.DurationFlag{
+			Name:  "retry_delay",
+			Value: retry.initialDelay,
+			Usage: "the delay before the first retry of a failed API call. It doubles for each following retry.",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "the timeout of each API call attempt and of each page fetch when listing users, e.g. 30s. No timeout if not set.",
+		},
+		cli.BoolFlag{
+			Name:  "verbose",
+			Usage: "print verbose logs.",
+		},
+		cli.BoolFlag{
+			Name:  "quiet",
+			Usage: "do not report the progress of bulk commands.",
+		},
+		cli.BoolFlag{
+			Name: "dry_run",
+			Usage: "print the payload of the calls which update, delete or upload users and of the OOB emails, " +
+				"with the secrets masked, instead of making them or sending them.",
+		},
+		cli.BoolFlag{
+			Name:  "debug_http",
+			Usage: "log the HTTP requests and responses of the API calls, with the tokens, passwords, hashes and salts redacted.",
+		},
+		cli.StringFlag{
+			Name:  "debug_http_har",
+			Usage: "also record the logged HTTP requests and responses in the HAR file. Implies -debug_http.",
+		},
+		cli.IntFlag{
+			Name:  "password_min_length",
+			Value: policy.minLength,
+			Usage: "the minimum length of new passwords.",
+		},
+		cli.IntFlag{
+			Name:  "password_min_classes",
+			Usage: "the minimum number of character classes (lowercase, uppercase, digit, symbol) in new passwords.",
+		},
+		cli.BoolFlag{
+			Name:  "password_allow_email",
+			Usage: "allow new passwords to contain the email address of the user.",
+		},
+		cli.StringFlag{
+			Name:  "breached_passwords",
+			Usage: "the file or directory of SHA-1 hashes of breached passwords which new passwords are checked against.",
+		},
 	}
-	app.Before = initClient
+	app.Before = initGlobals
 	app.Commands = []cli.Command{
-		commandValidateToken(),
-		commandGetUser(),
-		commandUpdateUser(),
-		commandDeleteUser(),
-		commandCreateUser(),
-		commandUploadUsers(),
-		commandDownloadUsers(),
-	}
-	app.RunAndExitOnError()
+		withClient(commandValidateToken()),
+		withClient(commandGetUser()),
+		withClient(commandUpdateUser()),
+		withClient(commandDeleteUser()),
+		withClient(commandCreateUser()),
+		withClient(commandCreateUsers()),
+		withClient(commandUploadUsers()),
+		withClient(commandDownloadUsers()),
+		withClient(commandSendOOB()),
+		withClient(commandSync()),
+		withClient(commandDiff()),
+		withClient(commandCopyUsers()),
+		// The commands below create the client themselves if they need
+		// it. anonymize works offline, checkpassword and seedusers only call
+		// the API in some modes, and doctor checks the configuration itself
+		// so that all the problems are reported instead of the first one.
+		commandCheckPassword(),
+		commandAnonymize(),
+		commandSeedUsers(),
+		commandDoctor(),
+	}
+	if err := app.Run(os.Args); err != nil {
+		exitWithError("", err)
+	}
+	writeHAR()
 }
 
-var client *gitkit.Client
+var client *retryingClient
 var clientID string
 
+// ctx is the context of the API calls. It is canceled when the program is
+// interrupted.
+var ctx = context.Background()
+
+// timeout is the timeout of each API call attempt and of each page fetch when
+// listing users.
+var timeout time.Duration
+
 type CliConfig struct {
-	ClientID string `json:"clientId,omitempty"`
-	GoogleAppCredentialsPath string `json:"googleAppCredentialsPath",omitempty"`
+	ClientID                 string `json:"clientId,omitempty"`
+	GoogleAppCredentialsPath string `json:"googleAppCredentialsPath,omitempty"`
+	// Named configurations of other projects, used by the commands working
+	// across projects.
+	Profiles map[string]*CliConfig `json:"profiles,omitempty"`
 }
 
+// cliConfig is the content of the config file.
+var cliConfig CliConfig
+
+// initGlobals sets the global options shared by all commands.
+func initGlobals(c *cli.Context) error {
+	switch f := c.String("error_format"); f {
+	case "text", "json":
+		errorFormat = f
+	default:
+		return argError("-error_format must be text or json")
+	}
+	verbose = c.Bool("verbose")
+	quiet = c.Bool("quiet")
+	dryRun = c.Bool("dry_run")
+	if c.Bool("debug_http") || c.IsSet("debug_http_har") {
+		httpDebug = newDebugTransport(c.String("debug_http_har"))
+	}
+	policy = passwordPolicy{
+		minLength:  c.Int("password_min_length"),
+		minClasses: c.Int("password_min_classes"),
+		allowEmail: c.Bool("password_allow_email"),
+	}
+	if c.IsSet("breached_passwords") {
+		policy.breached = &breachedList{path: c.String("breached_passwords")}
+	}
+	if c.Int("retries") < 0 {
+		return argError("-retries must not be negative")
+	}
+	retry.attempts = c.Int("retries") + 1
+	retry.initialDelay = c.Duration("retry_delay")
+	timeout = c.Duration("timeout")
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithCancel(context.Background())
+	handleInterrupt(cancel)
+	return nil
+}
+
+// withClient makes the command create the client before running.
+func withClient(cmd cli.Command) cli.Command {
+	action := cmd.Action.(func(*cli.Context))
+	cmd.Action = func(c *cli.Context) {
+		failOnError(c, initClient(c))
+		action(c)
+	}
+	return cmd
+}
+
+// initClient creates the client from the config file and the global flags.
 func initClient(c *cli.Context) error {
-	configFile := c.String("config_file")
+	configFile := c.GlobalString("config_file")
 	config := &gitkit.Config{}
 	var err error
 	if configFile != "" {
 		var b []byte
 		b, err = ioutil.ReadFile(configFile)
 		if err != nil {
-			return err
+			return argError("cannot read config file: %s", err)
 		}
-		var c CliConfig
-		if err = json.Unmarshal(b, &c); err != nil {
-			return err
+		if err = json.Unmarshal(b, &cliConfig); err != nil {
+			return argError("invalid config file: %s", err)
 		}
-		clientID = c.ClientID
-		config.GoogleAppCredentialsPath = c.GoogleAppCredentialsPath
+		clientID = cliConfig.ClientID
+		config.GoogleAppCredentialsPath = cliConfig.GoogleAppCredentialsPath
 	}
+	// Command line flags overwrite the values in config file.
+	if c.GlobalIsSet("client_id") {
+		clientID = c.GlobalString("client_id")
+	}
+	if c.GlobalIsSet("google_app_credentials_path") {
+		config.GoogleAppCredentialsPath = c.GlobalString("google_app_credentials_path")
+	}
+
+	client, err = newClient(config)
+	return err
+}
+
+// newClient creates the client with the retry policy.
+func newClient(config *gitkit.Config) (*retryingClient, error) {
 	// It is required but not used.
 	config.WidgetURL = "http://localhost"
-	// Command line flags overwrite the values in config file.
-	if c.IsSet("client_id") {
-		clientID = c.String("client_id")
+	gctx := context.Background()
+	if httpDebug != nil {
+		// The client makes its requests, including those fetching the
+		// access tokens, with the HTTP client of the context.
+		gctx = context.WithValue(gctx, oauth2.HTTPClient, &http.Client{Transport: httpDebug})
 	}
-	if c.IsSet("google_app_credentials_path") {
-		config.GoogleAppCredentialsPath = c.String("google_app_credentials_path")
+	gc, err := gitkit.New(gctx, config)
+	if err != nil {
+		return nil, authError(err)
+	}
+	hc, err := authorizedClient(gctx, config.GoogleAppCredentialsPath)
+	if err != nil {
+		return nil, authError(err)
 	}
+	return &retryingClient{gc, &retry, hc}, nil
+}
 
-	if client, err = gitkit.New(context.Background(), config); err != nil {
-		return err
+// profileClient creates the client for the named profile in the config file.
+func profileClient(name string) (*retryingClient, error) {
+	p, ok := cliConfig.Profiles[name]
+	if !ok {
+		return nil, argError("profile %s is not found in the config file", name)
 	}
-	return nil
+	return newClient(&gitkit.Config{GoogleAppCredentialsPath: p.GoogleAppCredentialsPath})
+}
+
+// handleInterrupt cancels the context on the first SIGINT or SIGTERM so that
+// the running command can shut down gracefully, and exits immediately on the
+// second one.
+func handleInterrupt(cancel context.CancelFunc) {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ch
+		log.Print("Interrupted, shutting down. Interrupt again to exit immediately.")
+		cancel()
+		<-ch
+		writeHAR()
+		os.Exit(exitInterrupted)
+	}()
 }
 
 func checkZeroArgument(c *cli.Context) error {
 	if n := len(c.Args()); n != 0 {
-		return fmt.Errorf("except 0 argument but got %d", n)
+		return argError("except 0 argument but got %d", n)
 	}
 	return nil
 }
 
 func checkOneArgument(c *cli.Context) error {
 	if n := len(c.Args()); n != 1 {
-		return fmt.Errorf("except 1 argument but got %d", n)
+		return argError("except 1 argument but got %d", n)
 	}
 	return nil
 }
 
 func checkZeroOrOneArgument(c *cli.Context) error {
 	if n := len(c.Args()); n > 1 {
-		return fmt.Errorf("except 0 or 1 argument but got %d", n)
+		return argError("except 0 or 1 argument but got %d", n)
 	}
 	return nil
 }
@@ -141,48 +318,148 @@ func printUser(user *gitkit.User) {
 
 func failOnError(c *cli.Context, err error) {
 	if err != nil {
-		log.Fatalf("Fail to execute command %s: %s", c.Command.Name, err)
+		exitWithError(c.Command.Name, err)
 	}
 }
 
 // getUserByIdentifier retrieves the account information specified by the
 // identifier, which could be an email addresss, a local ID or an ID token.
 func getUserByIdentifier(identifier string) (*gitkit.User, error) {
-	ctx := context.Background()
-	if _, err := mail.ParseAddress(identifier); err == nil {
-		return client.UserByEmail(ctx, identifier)
-	} else if _, err := client.ValidateToken(ctx, identifier, clientID); err == nil {
-		return client.UserByToken(ctx, identifier, clientID)
+	var u *gitkit.User
+	var err error
+	if _, err = mail.ParseAddress(identifier); err == nil {
+		u, err = client.UserByEmail(ctx, identifier)
+	} else if _, err = client.ValidateToken(ctx, identifier, clientID); err == nil {
+		u, err = client.UserByToken(ctx, identifier, clientID)
 	} else {
-		return client.UserByLocalID(ctx, identifier)
+		u, err = client.UserByLocalID(ctx, identifier)
 	}
+	if err == nil && u == nil {
+		err = &cliError{exitUserNotFound, fmt.Errorf("user %s not found", identifier)}
+	}
+	return u, err
 }
 
+// checkNewEmail verifies that email is a valid address which is not used by
+// any account other than u.
+func checkNewEmail(u *gitkit.User, email string) error {
+	if _, err := mail.ParseAddress(email); err != nil {
+		return argError("invalid email address %q: %s", email, err)
+	}
+	other, err := lookupUser(client.UserByEmail(ctx, email))
+	if err != nil {
+		return err
+	}
+	if other != nil && other.LocalID != u.LocalID {
+		return argError("email address %s is already used by user %s", email, other.LocalID)
+	}
+	return nil
+}
+
+// checkPhotoURL verifies that photoURL is an absolute http or https URL.
+func checkPhotoURL(photoURL string) error {
+	p, err := url.Parse(photoURL)
+	if err != nil {
+		return argError("invalid photo URL %q: %s", photoURL, err)
+	}
+	if (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+		return argError("invalid photo URL %q: must be an absolute http or https URL", photoURL)
+	}
+	return nil
+}
+
+// unlinkProvider removes the federated provider specified by providerID from
+// the user's provider list, as deleteProvider does on the server. An error is
+// returned if the provider is not linked to the user.
+func unlinkProvider(u *gitkit.User, providerID string) error {
+	infos := u.ProviderUserInfo[:0]
+	found := false
+	for _, p := range u.ProviderUserInfo {
+		if p.ProviderID == providerID {
+			found = true
+			continue
+		}
+		infos = append(infos, p)
+	}
+	if !found {
+		return argError("provider %s is not linked to user %s", providerID, u.LocalID)
+	}
+	u.ProviderUserInfo = infos
+	return nil
+}
+
+// randomBytes returns n cryptographically random bytes.
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// generateUser creates the user with the password hashed by HMAC_SHA1. The
+// local ID is left to be assigned by a localIDGenerator.
 func generateUser(email, password string, key, salt []byte) (*gitkit.User, error) {
-	u := gitkit.User{Email: email, Salt: salt}
-	mac := hmac.New(sha1.New, key)
-	mac.Write([]byte(password))
-	mac.Write(salt)
-	u.PasswordHash = mac.Sum(nil)
-	r, err := rand.Int(rand.Reader, big.NewInt(1e16))
+	h, err := hashPassword("HMAC_SHA1", password, salt, key)
 	if err != nil {
 		return nil, err
 	}
-	u.LocalID = fmt.Sprintf("id%16d", r)
-	return &u, nil
+	return &gitkit.User{Email: email, PasswordHash: h, Salt: salt}, nil
 }
 
-// readUsers reads the next n users from the decoder stream.
-func readUsers(d *json.Decoder, n int) ([]*gitkit.User, error) {
-	var users []*gitkit.User
-	for i := 0; i < n; i++ {
+// hashMetadata is the password hash metadata of an uploaded record. Users
+// without metadata are hashed with the options given on the command line.
+type hashMetadata struct {
+	// Algorithm of the password hash.
+	HashAlgorithm string `json:"hashAlgorithm"`
+	// Name of the hash key and salt separator in the keys file, if any.
+	HashKey string `json:"hashKey"`
+}
+
+// userRecord is a user read from the input with its hash metadata.
+type userRecord struct {
+	*gitkit.User
+	hashMetadata
+	// Reason why the record cannot be uploaded, e.g. an invalid value of a
+	// mapped field, or nil. Such records are rejected by the uploader.
+	err error
+}
+
+// userReader returns the next user from the input, or io.EOF at the end of
+// it.
+type userReader func() (*userRecord, error)
+
+// jsonUserReader reads the users in the format written by downloadusers, in
+// which each record may also have the hashAlgorithm and hashKey fields.
+func jsonUserReader(d *json.Decoder) userReader {
+	return func() (*userRecord, error) {
+		var raw json.RawMessage
+		if err := d.Decode(&raw); err != nil {
+			return nil, err
+		}
 		var u gitkit.User
-		if err := d.Decode(&u); err != nil {
-			return users, err
+		if err := json.Unmarshal(raw, &u); err != nil {
+			return nil, err
 		}
-		users = append(users, &u)
+		r := &userRecord{User: &u}
+		if err := json.Unmarshal(raw, &r.hashMetadata); err != nil {
+			return nil, err
+		}
+		return r, nil
 	}
-	return users, nil
+}
+
+// readUsers reads the next n users from the reader.
+func readUsers(r userReader, n int) ([]*userRecord, error) {
+	var records []*userRecord
+	for i := 0; i < n; i++ {
+		u, err := r()
+		if err != nil {
+			return records, err
+		}
+		records = append(records, u)
+	}
+	return records, nil
 }
 
 func commandValidateToken() cli.Command {
@@ -192,7 +469,7 @@ func commandValidateToken() cli.Command {
 		Description: "Validate the given ID token and print the account information contained in it.",
 		Action: func(c *cli.Context) {
 			failOnError(c, checkOneArgument(c))
-			t, err := client.ValidateToken(context.Background(), c.Args().First(), clientID)
+			t, err := client.ValidateToken(ctx, c.Args().First(), clientID)
 			failOnError(c, err)
 			fmt.Println(">> token info:")
 			printUser(&gitkit.User{
@@ -225,39 +502,94 @@ func commandUpdateUser() cli.Command {
 		Name:        "updateuser",
 		Usage:       "updateuser [Options] EMAIL|LOCAL_ID|ID_TOKEN",
 		Description: "Update the account information of the user specified by the email address, local user ID or ID token.",
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			cli.StringFlag{
 				Name:  "name",
 				Usage: "the new display name for the user.",
 			},
 			cli.BoolFlag{
 				Name:  "password",
-				Usage: "whether to set a new password.",
+				Usage: "whether to set a new password. It is prompted to enter unless a password option is given.",
 			},
 			cli.BoolFlag{
 				Name:  "email_verified",
 				Usage: "whether the email address is verified.",
 			},
-		},
+			cli.StringFlag{
+				Name:  "email",
+				Usage: "the new email address for the user.",
+			},
+			cli.StringFlag{
+				Name:  "photo_url",
+				Usage: "the new photo URL for the user.",
+			},
+			cli.BoolFlag{
+				Name:  "disable",
+				Usage: "disable the account.",
+			},
+			cli.BoolFlag{
+				Name:  "enable",
+				Usage: "enable the account.",
+			},
+			cli.StringFlag{
+				Name:  "unlink_provider",
+				Usage: "the ID of the federated provider to unlink from the account, e.g. google.com.",
+			},
+		}, passwordFlags()...),
 		Action: func(c *cli.Context) {
 			failOnError(c, checkOneArgument(c))
+			if c.IsSet("disable") && c.IsSet("enable") {
+				failOnError(c, argError("-disable and -enable are mutually exclusive"))
+			}
 			u, err := getUserByIdentifier(c.Args().First())
 			failOnError(c, err)
+			// The changes which UpdateUser does not send, if any.
+			info := &setAccountInfoRequest{LocalID: u.LocalID}
+			if c.IsSet("email") {
+				failOnError(c, checkNewEmail(u, c.String("email")))
+				u.Email = c.String("email")
+			}
+			if c.IsSet("photo_url") {
+				failOnError(c, checkPhotoURL(c.String("photo_url")))
+				u.PhotoURL = c.String("photo_url")
+				info.PhotoURL = u.PhotoURL
+			}
+			if c.IsSet("disable") || c.IsSet("enable") {
+				u.Disabled = c.IsSet("disable")
+				info.DisableUser = &u.Disabled
+			}
+			if c.IsSet("unlink_provider") {
+				failOnError(c, unlinkProvider(u, c.String("unlink_provider")))
+				info.DeleteProvider = []string{c.String("unlink_provider")}
+			}
 			if c.IsSet("name") {
 				u.DisplayName = c.String("name")
 			}
-			if c.IsSet("password") {
-				fmt.Print("New password: ")
-				password := string(gopass.GetPasswd())
+			setPassword := c.IsSet("password") || hasPasswordOption(c)
+			if setPassword {
+				password, err := readPassword(c, "New password: ")
+				failOnError(c, err)
 				if password != "" {
+					failOnError(c, policy.check(password, u.Email))
 					u.Password = password
 				}
 			}
 			if c.IsSet("email_verified") {
 				u.EmailVerified = c.Bool("email_verified")
 			}
-			failOnError(c, client.UpdateUser(context.Background(), u))
-			if c.IsSet("password") {
+			if info.empty() {
+				failOnError(c, client.UpdateUser(ctx, u))
+			} else {
+				// All the changes are sent in one call, so that they are
+				// applied together or not at all.
+				info.Email, info.DisplayName, info.Password = u.Email, u.DisplayName, u.Password
+				info.EmailVerified = &u.EmailVerified
+				failOnError(c, client.setAccountInfo(ctx, info))
+			}
+			if dryRun {
+				return
+			}
+			if setPassword {
 				// If a new password is set, the new PasswordHash need to be retrieved.
 				if u, err = getUserByIdentifier(u.LocalID); err != nil {
 					failOnError(c, err)
@@ -278,7 +610,10 @@ func commandDeleteUser() cli.Command {
 			failOnError(c, checkOneArgument(c))
 			u, err := getUserByIdentifier(c.Args().First())
 			failOnError(c, err)
-			failOnError(c, client.DeleteUser(context.Background(), u))
+			failOnError(c, client.DeleteUser(ctx, u))
+			if dryRun {
+				return
+			}
 			fmt.Println(">> user deleted:")
 			printUser(u)
 		},
@@ -288,26 +623,48 @@ func commandDeleteUser() cli.Command {
 func commandCreateUser() cli.Command {
 	return cli.Command{
 		Name:        "createuser",
-		Usage:       "createuser",
-		Description: "Create a new user account. The email address and password are prompted to enter.",
+		Usage:       "createuser [Options]",
+		Description: "Create a new user account. The email address and password are prompted to enter unless given by the options.",
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "email",
+				Usage: "the email address of the user.",
+			},
+			localIDStrategyFlag("random"),
+			cli.StringFlag{
+				Name:  "local_id",
+				Usage: "the local ID of the user, used by the from-field local ID strategy.",
+			},
+			normalizeEmailsFlag,
+		}, passwordFlags()...),
 		Action: func(c *cli.Context) {
 			failOnError(c, checkZeroArgument(c))
-			key := make([]byte, 32)
-			salt := make([]byte, 10)
-			if _, err := rand.Read(key); err != nil {
-				failOnError(c, err)
+			g, err := newLocalIDGenerator(c.String("local_id_strategy"), client)
+			failOnError(c, err)
+			key, err := randomBytes(32)
+			failOnError(c, err)
+			salt, err := randomBytes(10)
+			failOnError(c, err)
+			email := c.String("email")
+			if !c.IsSet("email") {
+				fmt.Print("Email: ")
+				fmt.Scanf("%s\n", &email)
 			}
-			if _, err := rand.Read(salt); err != nil {
+			if c.Bool("normalize_emails") {
+				email, err = normalizeEmail(email)
 				failOnError(c, err)
 			}
-			fmt.Print("Email: ")
-			var email string
-			fmt.Scanf("%s\n", &email)
-			fmt.Print("Password: ")
-			password := string(gopass.GetPasswd())
+			password, err := readPassword(c, "Password: ")
+			failOnError(c, err)
+			failOnError(c, policy.check(password, email))
 			u, err := generateUser(email, password, key, salt)
 			failOnError(c, err)
-			failOnError(c, client.UploadUsers(context.Background(), []*gitkit.User{u}, "HMAC_SHA1", key, nil))
+			u.LocalID = c.String("local_id")
+			failOnError(c, g.assign(u))
+			failOnError(c, client.UploadUsers(ctx, []*gitkit.User{u}, "HMAC_SHA1", key, nil))
+			if dryRun {
+				return
+			}
 			u, err = getUserByIdentifier(u.Email)
 			failOnError(c, err)
 			fmt.Println(">> user created:")
@@ -316,11 +673,107 @@ func commandCreateUser() cli.Command {
 	}
 }
 
+func commandCreateUsers() cli.Command {
+	return cli.Command{
+		Name:  "createusers",
+		Usage: "createusers [Options] USERS_CSV_FILE",
+		Description: "Create the user accounts listed in the CSV file, one \"email,password[,local_id]\" record per line. " +
+			"Lines starting with # are ignored. The passwords are hashed locally before uploading.",
+		Flags: []cli.Flag{
+			localIDStrategyFlag("random"),
+		},
+		Action: func(c *cli.Context) {
+			failOnError(c, checkOneArgument(c))
+			g, err := newLocalIDGenerator(c.String("local_id_strategy"), client)
+			failOnError(c, err)
+			f, err := os.Open(c.Args().First())
+			failOnError(c, err)
+			defer f.Close()
+			r := csv.NewReader(f)
+			r.Comment = '#'
+			r.FieldsPerRecord = -1
+			key, err := randomBytes(32)
+			failOnError(c, err)
+			p := newProgress(c.Command.Name, nil, 0)
+			failed, created := 0, 0
+			for done := false; !done; {
+				if ctx.Err() != nil {
+					p.finish()
+					fmt.Printf(">> interrupted, %d users %s\n", created, wouldBe("created"))
+					failOnError(c, ctx.Err())
+				}
+				var users []*gitkit.User
+				rejected := 0
+				for len(users) < 20 {
+					rec, err := r.Read()
+					if err == io.EOF {
+						done = true
+						break
+					}
+					failOnError(c, err)
+					if len(rec) != 2 && len(rec) != 3 {
+						failOnError(c, argError("expect 2 or 3 fields but got %d in record %q", len(rec), rec))
+					}
+					email := strings.TrimSpace(rec[0])
+					if err := policy.check(rec[1], email); err != nil {
+						p.printf(">> rejected password of user %s: %s\n", email, err)
+						rejected++
+						continue
+					}
+					salt, err := randomBytes(10)
+					failOnError(c, err)
+					u, err := generateUser(email, rec[1], key, salt)
+					failOnError(c, err)
+					if len(rec) == 3 {
+						u.LocalID = strings.TrimSpace(rec[2])
+					}
+					if err := g.assign(u); err != nil {
+						if exitCode(err) != exitInvalidArgument {
+							failOnError(c, err)
+						}
+						p.printf(">> rejected user %s: %s\n", email, err)
+						rejected++
+						continue
+					}
+					users = append(users, u)
+				}
+				failed += rejected
+				p.add(0, rejected)
+				if len(users) == 0 {
+					continue
+				}
+				err := client.UploadUsers(context.Background(), users, "HMAC_SHA1", key, nil)
+				batchFailed := 0
+				if uploadErr, ok := err.(gitkit.UploadError); ok {
+					for _, v := range uploadErr {
+						p.printf(">> failed to create user %s: %s\n", users[v.Index].Email, v.Message)
+					}
+					batchFailed = len(uploadErr)
+				} else {
+					failOnError(c, err)
+				}
+				failed += batchFailed
+				created += len(users) - batchFailed
+				p.add(len(users), batchFailed)
+			}
+			p.finish()
+			fmt.Printf(">> %d users %s\n", created, wouldBe("created"))
+			fmt.Println(">> done")
+			if failed > 0 {
+				failOnError(c, &cliError{exitPartialUpload, fmt.Errorf("failed to create %d users", failed)})
+			}
+		},
+	}
+}
+
 func commandUploadUsers() cli.Command {
 	return cli.Command{
-		Name:        "uploadusers",
-		Usage:       "uploadusers [Options] USERS_FILE",
-		Description: "Upload the user accounts in the file.",
+		Name:  "uploadusers",
+		Usage: "uploadusers [Options] USERS_FILE|SHARD_DIR|-",
+		Description: "Upload the user accounts in the file, or in the shard directory written by downloadusers. " +
+			"If the file is -, standard input is used. Gzip and zstd compressed input is detected automatically. " +
+			"Records with the hashAlgorithm field, and optionally the hashKey field naming a key in the keys file, " +
+			"are uploaded with these hash options instead of those given by the options.",
 		Flags: []cli.Flag{
 			cli.StringFlag{
 				Name:  "algorithm",
@@ -334,37 +787,105 @@ func commandUploadUsers() cli.Command {
 				Name:  "salt_separator",
 				Usage: "URL safe base64 encoded salt separator.",
 			},
+			cli.StringFlag{
+				Name:  "keys",
+				Usage: "the JSON file mapping the key names used by the hashKey field of the records to the hash keys and salt separators.",
+			},
+			localIDStrategyFlag("from-field"),
+			cli.StringFlag{
+				Name: "on_conflict",
+				Usage: "what to do if the email address or local ID of a user is already used: skip, overwrite, merge or fail. " +
+					"If not set, the existing accounts are not checked.",
+			},
+			cli.StringFlag{
+				Name: "merge_priority",
+				Usage: "comma separated fields in which the uploaded value takes priority over the existing one in merge mode. " +
+					"For the other fields the existing value is kept unless it is empty. Default to all fields: " +
+					strings.Join(mergeFields, ", ") + ".",
+			},
+			cli.StringFlag{
+				Name:  "mapping",
+				Usage: "the YAML file mapping the fields of the JSON or CSV input to the user account fields.",
+			},
+			normalizeEmailsFlag,
+			cli.BoolFlag{
+				Name: "verify",
+				Usage: "fetch each uploaded user back after its batch and report the differences in " +
+					"the email address, display name, email verification and providers.",
+			},
 		},
 		Action: func(c *cli.Context) {
 			failOnError(c, checkOneArgument(c))
-			if !c.IsSet("algorithm") || c.IsSet("hash_key") {
-				failOnError(c, fmt.Errorf("-algorithm and -hash_key are required"))
+			// With a keys file, the hash options are only required for the
+			// records without hash metadata.
+			if !c.IsSet("keys") && (!c.IsSet("algorithm") || !c.IsSet("hash_key")) {
+				failOnError(c, argError("-algorithm and -hash_key are required"))
 			}
+			up := &uploader{c: c, normalize: c.Bool("normalize_emails"), verify: c.Bool("verify")}
 			key, err := base64.URLEncoding.DecodeString(c.String("hash_key"))
 			failOnError(c, err)
 			separator, err := base64.URLEncoding.DecodeString(c.String("salt_separator"))
 			failOnError(c, err)
-			f, err := os.Open(c.Args().First())
+			up.defaults = hashOptions{c.String("algorithm"), string(key), string(separator)}
+			if c.IsSet("keys") {
+				up.keys, err = loadHashKeys(c.String("keys"))
+				failOnError(c, err)
+			}
+			// The existing accounts are only checked for collisions if a
+			// strategy is chosen explicitly, as it takes one call per user.
+			var check *retryingClient
+			if c.IsSet("local_id_strategy") {
+				check = client
+			}
+			up.ids, err = newLocalIDGenerator(c.String("local_id_strategy"), check)
+			failOnError(c, err)
+			switch up.onConflict = c.String("on_conflict"); up.onConflict {
+			case "", conflictSkip, conflictOverwrite, conflictMerge, conflictFail:
+			default:
+				failOnError(c, argError("-on_conflict must be skip, overwrite, merge or fail"))
+			}
+			up.priority, err = parseMergePriority(c.String("merge_priority"))
+			failOnError(c, err)
+			f, size, err := openUsers(c.Args().First())
 			failOnError(c, err)
 			defer f.Close()
-			d := json.NewDecoder(f)
+			in := &countingReader{r: f}
+			r := jsonUserReader(json.NewDecoder(in))
+			if c.IsSet("mapping") {
+				m, err := loadMapping(c.String("mapping"))
+				failOnError(c, err)
+				r, err = m.reader(in)
+				failOnError(c, err)
+			}
+			up.p = newProgress(c.Command.Name, in, size)
 			for done := false; !done; {
-				users, err := readUsers(d, 20)
+				records, err := readUsers(r, uploadBatchSize)
 				if err == io.EOF {
 					done = true
 				} else {
 					failOnError(c, err)
 				}
-				err = client.UploadUsers(context.Background(), users, c.String("algorithm"), key, separator)
-				if uploadErr, ok := err.(gitkit.UploadError); ok {
-					for _, v := range uploadErr {
-						fmt.Printf(">> failed to upload user %s: %s\n", users[v.Index].Email, v.Message)
-					}
-				} else {
-					failOnError(c, err)
+				up.add(records)
+				if ctx.Err() != nil {
+					// add stops at the first user not processed, and the
+					// pending batches are uploaded first, so that the
+					// processed users are exactly the first ones of the
+					// input.
+					up.flush()
+					up.p.finish()
+					fmt.Printf(">> interrupted after batch %d, %d users processed\n", up.batch, up.processed)
+					failOnError(c, ctx.Err())
 				}
 			}
+			up.flush()
+			up.p.finish()
 			fmt.Println(">> done")
+			if up.failed > 0 {
+				failOnError(c, &cliError{exitPartialUpload, fmt.Errorf("failed to upload %d users", up.failed)})
+			}
+			if up.mismatched > 0 {
+				failOnError(c, &cliError{exitPartialUpload, fmt.Errorf("%d uploaded users differ from the input", up.mismatched)})
+			}
 		},
 	}
 }
@@ -372,10 +893,57 @@ func commandUploadUsers() cli.Command {
 func commandDownloadUsers() cli.Command {
 	return cli.Command{
 		Name:        "downloadusers",
-		Usage:       "downloadusers [output]",
+		Usage:       "downloadusers [Options] [output]",
 		Description: "Download all user accounts. If output is not specified or -, standard output is used.",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "output_dir",
+				Usage: "the directory to write the users into as numbered shard files, with an index file.",
+			},
+			cli.IntFlag{
+				Name:  "shard_size",
+				Usage: "the maximum number of users in a shard.",
+			},
+			cli.IntFlag{
+				Name:  "shard_bytes",
+				Usage: "the maximum uncompressed size of a shard in bytes, unless it holds a single larger user.",
+			},
+			cli.BoolFlag{
+				Name:  "gzip",
+				Usage: "whether to gzip the shard files.",
+			},
+		},
 		Action: func(c *cli.Context) {
 			failOnError(c, checkZeroOrOneArgument(c))
+			if c.IsSet("output_dir") {
+				failOnError(c, checkZeroArgument(c))
+				if c.Int("shard_size") < 0 || c.Int("shard_bytes") < 0 {
+					failOnError(c, argError("-shard_size and -shard_bytes must not be negative"))
+				}
+				w, err := newShardWriter(c.String("output_dir"), c.Int("shard_size"), int64(c.Int("shard_bytes")), c.Bool("gzip"))
+				failOnError(c, err)
+				p := newProgress(c.Command.Name, nil, 0)
+				err = client.listUsers(ctx, func(u *gitkit.User) error {
+					p.add(1, 0)
+					return w.write(u)
+				})
+				p.finish()
+				// The index is written even on failure so that the shards
+				// downloaded so far can be used.
+				if cerr := w.close(); err == nil {
+					err = cerr
+				}
+				if ctx.Err() != nil {
+					fmt.Fprintf(os.Stderr, ">> interrupted, %d users downloaded\n", w.records)
+				}
+				failOnError(c, err)
+				fmt.Printf(">> %d users written to %d shards in %s\n", w.records, len(w.index.Shards), c.String("output_dir"))
+				fmt.Println(">> done")
+				return
+			}
+			if c.IsSet("shard_size") || c.IsSet("shard_bytes") || c.IsSet("gzip") {
+				failOnError(c, argError("-shard_size, -shard_bytes and -gzip require -output_dir"))
+			}
 			var f *os.File
 			var err error
 			if len(c.Args()) == 0 || c.Args().First() == "-" {
@@ -385,24 +953,23 @@ func commandDownloadUsers() cli.Command {
 				failOnError(c, err)
 				defer f.Close()
 			}
-			ctx := context.Background()
-			l := client.ListUsers(ctx)
-			maxRetries := 5
-			i := 0
-			for {
-				for u := range l.C {
-					b, err := json.MarshalIndent(u, "", "  ")
-					failOnError(c, err)
-					fmt.Fprintln(f, string(b))
-				}
-				if l.Error != nil && i < maxRetries {
-					i++
-					l.Retry(ctx)
-					continue
+			n := 0
+			p := newProgress(c.Command.Name, nil, 0)
+			err = client.listUsers(ctx, func(u *gitkit.User) error {
+				b, err := json.MarshalIndent(u, "", "  ")
+				if err != nil {
+					return err
 				}
-				break
+				n++
+				p.add(1, 0)
+				_, err = fmt.Fprintln(f, string(b))
+				return err
+			})
+			p.finish()
+			if ctx.Err() != nil {
+				fmt.Fprintf(os.Stderr, ">> interrupted, %d users downloaded\n", n)
 			}
-			failOnError(c, l.Error)
+			failOnError(c, err)
 			fmt.Println(">> done")
 		},
 	}
@@ -0,0 +1,42 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestCliConfigTags checks the JSON tags of the config fields, which
+// encoding/json silently ignores when they are malformed.
+func TestCliConfigTags(t *testing.T) {
+	typ := reflect.TypeOf(CliConfig{})
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		tag, ok := f.Tag.Lookup("json")
+		if !ok {
+			t.Errorf("%s has no well formed json tag: `%s`", f.Name, f.Tag)
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		if name := parts[0]; name == "" || strings.ToLower(name[:1]) != name[:1] {
+			t.Errorf("%s has json name %q, want a lower camel case name", f.Name, name)
+		}
+		if len(parts) != 2 || parts[1] != "omitempty" {
+			t.Errorf("%s has json options %q, want omitempty", f.Name, parts[1:])
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Magic numbers of the supported compression formats.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// readCloser combines the decompressed stream with the close function which
+// releases both the decompressor and the underlying input.
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
+
+// decompress detects whether the input is gzip or zstd compressed by its
+// magic number and returns the decompressed stream if it is. compressed
+// reports whether the input is compressed.
+func decompress(rc io.ReadCloser) (r io.ReadCloser, compressed bool, err error) {
+	br := bufio.NewReader(rc)
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, false, err
+		}
+		return &readCloser{gz, func() error {
+			gz.Close()
+			return rc.Close()
+		}}, true, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, false, err
+		}
+		return &readCloser{zr, func() error {
+			zr.Close()
+			return rc.Close()
+		}}, true, nil
+	}
+	return &readCloser{br, rc.Close}, false, nil
+}
+
+// openUsers opens the users file, the shard directory written by
+// downloadusers, or standard input if path is -. Compressed files are
+// decompressed transparently. The size of the input in bytes is returned if
+// known, or 0 otherwise.
+func openUsers(path string) (io.ReadCloser, int64, error) {
+	if path == "-" {
+		r, _, err := decompress(ioutil.NopCloser(os.Stdin))
+		return r, 0, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if fi.IsDir() {
+		return openShards(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	r, compressed, err := decompress(f)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if compressed {
+		// The progress is measured on the decompressed stream, whose size is
+		// unknown.
+		return r, 0, nil
+	}
+	return r, fi.Size(), nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+// Maximum number of attempts to generate a random local ID which is not used.
+const maxLocalIDAttempts = 5
+
+// localIDStrategyFlag returns the option for choosing how local IDs are
+// generated, with the default strategy of the command.
+func localIDStrategyFlag(def string) cli.Flag {
+	return cli.StringFlag{
+		Name:  "local_id_strategy",
+		Value: def,
+		Usage: "how local IDs are generated: random, uuid, prefix:<PREFIX>, hash-of-email or from-field.",
+	}
+}
+
+// localIDGenerator generates the local IDs of new users according to the
+// strategy:
+//   - random: "id" followed by 16 random digits.
+//   - uuid: a random version 4 UUID.
+//   - prefix:<PREFIX>: PREFIX followed by 16 random digits.
+//   - hash-of-email: the first 32 hex digits of the SHA-256 hash of the
+//     lowercased email address.
+//   - from-field: the local ID given in the input.
+type localIDGenerator struct {
+	strategy string
+	prefix   string
+	// The client to check the IDs against the existing accounts with, or nil
+	// for not checking.
+	client *retryingClient
+	// The IDs assigned so far, to detect collisions within the input.
+	assigned map[string]string
+}
+
+// newLocalIDGenerator parses the strategy and creates the generator. The IDs
+// are checked against the existing accounts of the client if it is not nil.
+func newLocalIDGenerator(strategy string, c *retryingClient) (*localIDGenerator, error) {
+	g := &localIDGenerator{strategy: strategy, client: c, assigned: make(map[string]string)}
+	switch {
+	case strategy == "random":
+		g.prefix = "id"
+	case strings.HasPrefix(strategy, "prefix:"):
+		g.strategy = "prefix"
+		g.prefix = strings.TrimPrefix(strategy, "prefix:")
+		if g.prefix == "" {
+			return nil, argError("empty prefix in local ID strategy %s", strategy)
+		}
+	case strategy == "uuid", strategy == "hash-of-email", strategy == "from-field":
+	default:
+		return nil, argError("unknown local ID strategy %s", strategy)
+	}
+	return g, nil
+}
+
+// random reports whether the strategy generates random IDs, which can be
+// regenerated on collision.
+func (g *localIDGenerator) random() bool {
+	return g.strategy == "random" || g.strategy == "prefix" || g.strategy == "uuid"
+}
+
+func (g *localIDGenerator) generate(u *gitkit.User) (string, error) {
+	switch g.strategy {
+	case "uuid":
+		b, err := randomBytes(16)
+		if err != nil {
+			return "", err
+		}
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+	case "hash-of-email":
+		if u.Email == "" {
+			return "", argError("hash-of-email requires the email address")
+		}
+		sum := sha256.Sum256([]byte(strings.ToLower(u.Email)))
+		return hex.EncodeToString(sum[:16]), nil
+	case "from-field":
+		if u.LocalID == "" {
+			return "", argError("no local ID given for user %s", u.Email)
+		}
+		return u.LocalID, nil
+	}
+	r, err := rand.Int(rand.Reader, big.NewInt(1e16))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%016d", g.prefix, r), nil
+}
+
+// collides reports whether the local ID is already used by another user,
+// either in the input or in the existing accounts.
+func (g *localIDGenerator) collides(id string, u *gitkit.User) (bool, error) {
+	if email, ok := g.assigned[id]; ok && !strings.EqualFold(email, u.Email) {
+		return true, nil
+	}
+	if g.client == nil {
+		return false, nil
+	}
+	existing, err := lookupUser(g.client.UserByLocalID(ctx, id))
+	if err != nil {
+		return false, err
+	}
+	return existing != nil && !strings.EqualFold(existing.Email, u.Email), nil
+}
+
+// assign sets the local ID of the user according to the strategy. Random IDs
+// are regenerated on collision, while a collision of a deterministic ID is an
+// error.
+func (g *localIDGenerator) assign(u *gitkit.User) error {
+	for i := 0; i < maxLocalIDAttempts; i++ {
+		id, err := g.generate(u)
+		if err != nil {
+			return err
+		}
+		collides, err := g.collides(id, u)
+		if err != nil {
+			return err
+		}
+		if !collides {
+			u.LocalID = id
+			g.assigned[id] = u.Email
+			return nil
+		}
+		if !g.random() {
+			return argError("local ID %s of user %s is already used by another user", id, u.Email)
+		}
+		logVerbose("Local ID %s is already used, regenerating", id)
+	}
+	return fmt.Errorf("cannot generate an unused local ID for user %s", u.Email)
+}
+
+// lookupUser converts the result of a user lookup so that a user which does
+// not exist is returned as nil without error.
+func lookupUser(u *gitkit.User, err error) (*gitkit.User, error) {
+	if err != nil && isNotFound(err) {
+		return nil, nil
+	}
+	return u, err
+}
@@ -0,0 +1,287 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/google/identity-toolkit-go-client/gitkit"
+	"gopkg.in/yaml.v2"
+)
+
+// Types of the gitkit.User fields which can be mapped, by their JSON keys, and
+// of the hash metadata fields.
+var mappedFieldTypes = map[string]string{
+	"localId":       "string",
+	"email":         "string",
+	"emailVerified": "bool",
+	"displayName":   "string",
+	"photoUrl":      "string",
+	"passwordHash":  "bytes",
+	"salt":          "bytes",
+	"disabled":      "bool",
+	"hashAlgorithm": "string",
+	"hashKey":       "string",
+}
+
+// Transforms of the string values. The decoding transforms turn the value
+// into bytes and must come last.
+var (
+	stringTransforms = map[string]func(string) string{
+		"lowercase": strings.ToLower,
+		"uppercase": strings.ToUpper,
+		"trim":      strings.TrimSpace,
+	}
+	decodeTransforms = map[string]func(string) ([]byte, error){
+		"hex":          hex.DecodeString,
+		"base64":       base64.StdEncoding.DecodeString,
+		"base64url":    base64.URLEncoding.DecodeString,
+		"base64raw":    base64.RawStdEncoding.DecodeString,
+		"base64urlraw": base64.RawURLEncoding.DecodeString,
+	}
+)
+
+// fieldMapping describes how the value of a gitkit.User field is obtained.
+type fieldMapping struct {
+	// JSON path of the source field, e.g. "profile.emails[0]", or the CSV
+	// column name.
+	Source string `yaml:"source"`
+	// Constant value used instead of a source field.
+	Constant interface{} `yaml:"constant"`
+	// Transforms applied to the value in order.
+	Transform []string `yaml:"transform"`
+}
+
+// userMapping maps the records of a JSON or CSV file to gitkit.User.
+//
+// An example mapping file:
+//
+//	format: csv
+//	fields:
+//	  localId:
+//	    source: user_id
+//	  email:
+//	    source: email
+//	    transform: [trim, lowercase]
+//	  passwordHash:
+//	    source: pw_hash
+//	    transform: [hex]
+//	  emailVerified:
+//	    constant: true
+type userMapping struct {
+	// Format of the input, json (the default) or csv.
+	Format string                   `yaml:"format"`
+	Fields map[string]*fieldMapping `yaml:"fields"`
+}
+
+// loadMapping reads and validates the mapping file.
+func loadMapping(path string) (*userMapping, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, argError("cannot read mapping file: %s", err)
+	}
+	var m userMapping
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return nil, argError("invalid mapping file: %s", err)
+	}
+	if m.Format == "" {
+		m.Format = "json"
+	}
+	if m.Format != "json" && m.Format != "csv" {
+		return nil, argError("invalid mapping file: format must be json or csv")
+	}
+	for field, f := range m.Fields {
+		typ, ok := mappedFieldTypes[field]
+		if !ok {
+			return nil, argError("invalid mapping file: unknown field %s", field)
+		}
+		if (f.Source == "") == (f.Constant == nil) {
+			return nil, argError("invalid mapping file: field %s needs either source or constant", field)
+		}
+		decoded := false
+		for i, t := range f.Transform {
+			if _, ok := decodeTransforms[t]; ok {
+				if i != len(f.Transform)-1 {
+					return nil, argError("invalid mapping file: transform %s of field %s must be the last one", t, field)
+				}
+				decoded = true
+			} else if _, ok := stringTransforms[t]; !ok {
+				return nil, argError("invalid mapping file: unknown transform %s of field %s", t, field)
+			}
+		}
+		if decoded != (typ == "bytes") {
+			if decoded {
+				return nil, argError("invalid mapping file: field %s cannot be decoded into bytes", field)
+			}
+			return nil, argError("invalid mapping file: field %s needs a decoding transform, e.g. hex or base64", field)
+		}
+	}
+	return &m, nil
+}
+
+// lookupJSONPath returns the value at the path, e.g. "a.b[0].c", in the
+// decoded JSON value.
+func lookupJSONPath(v interface{}, path string) (interface{}, bool) {
+	for _, part := range strings.Split(path, ".") {
+		name, index := part, ""
+		if i := strings.IndexByte(part, '['); i >= 0 && strings.HasSuffix(part, "]") {
+			name, index = part[:i], part[i+1:len(part)-1]
+		}
+		if name != "" {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if v, ok = m[name]; !ok {
+				return nil, false
+			}
+		}
+		if index != "" {
+			a, ok := v.([]interface{})
+			n, err := strconv.Atoi(index)
+			if !ok || err != nil || n < 0 || n >= len(a) {
+				return nil, false
+			}
+			v = a[n]
+		}
+	}
+	return v, true
+}
+
+// mapValue converts the source value into the type of the field, applying the
+// transforms.
+func mapValue(field string, f *fieldMapping, v interface{}) (interface{}, error) {
+	var s string
+	switch t := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		s = t
+	case bool:
+		s = strconv.FormatBool(t)
+	case float64:
+		s = strconv.FormatFloat(t, 'f', -1, 64)
+	default:
+		return nil, argError("field %s: unsupported value %v", field, v)
+	}
+	for _, t := range f.Transform {
+		if decode, ok := decodeTransforms[t]; ok {
+			b, err := decode(s)
+			if err != nil {
+				return nil, argError("field %s: cannot decode %s: %s", field, t, err)
+			}
+			return b, nil
+		}
+		s = stringTransforms[t](s)
+	}
+	if mappedFieldTypes[field] == "bool" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, argError("field %s: invalid boolean %q", field, s)
+		}
+		return b, nil
+	}
+	return s, nil
+}
+
+// apply builds the user from a record, whose source fields are returned by
+// get. The fields whose value is invalid are left unset, and the first error
+// is kept in the record so that it is rejected.
+func (m *userMapping) apply(get func(source string) (interface{}, bool)) (*userRecord, error) {
+	var r userRecord
+	values := make(map[string]interface{})
+	for field, f := range m.Fields {
+		v := f.Constant
+		if f.Source != "" {
+			var ok bool
+			if v, ok = get(f.Source); !ok {
+				continue
+			}
+		}
+		mv, err := mapValue(field, f, v)
+		if err != nil {
+			if r.err == nil {
+				r.err = err
+			}
+			continue
+		}
+		if mv != nil {
+			values[field] = mv
+		}
+	}
+	r.HashAlgorithm, _ = values["hashAlgorithm"].(string)
+	r.HashKey, _ = values["hashKey"].(string)
+	delete(values, "hashAlgorithm")
+	delete(values, "hashKey")
+	// The values have the Go types of the fields, so that they are converted
+	// to gitkit.User through its JSON encoding.
+	b, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	var u gitkit.User
+	if err := json.Unmarshal(b, &u); err != nil {
+		return nil, err
+	}
+	r.User = &u
+	return &r, nil
+}
+
+// reader returns the userReader which maps the records in r.
+func (m *userMapping) reader(r io.Reader) (userReader, error) {
+	if m.Format == "json" {
+		d := json.NewDecoder(r)
+		return func() (*userRecord, error) {
+			var v interface{}
+			if err := d.Decode(&v); err != nil {
+				return nil, err
+			}
+			return m.apply(func(source string) (interface{}, bool) {
+				return lookupJSONPath(v, source)
+			})
+		}, nil
+	}
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CSV header: %s", err)
+	}
+	columns := make(map[string]int)
+	for i, h := range header {
+		columns[strings.TrimSpace(h)] = i
+	}
+	return func() (*userRecord, error) {
+		rec, err := cr.Read()
+		if err != nil {
+			return nil, err
+		}
+		return m.apply(func(source string) (interface{}, bool) {
+			// Empty cells are treated as absent.
+			i, ok := columns[source]
+			if !ok || i >= len(rec) || rec[i] == "" {
+				return nil, false
+			}
+			return rec[i], true
+		})
+	}, nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/codegangsta/cli"
+	"github.com/howeyc/gopass"
+)
+
+// passwordFlags returns the options for providing the password without
+// prompting for it.
+func passwordFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.BoolFlag{
+			Name:  "password_stdin",
+			Usage: "read the password from the first line of standard input.",
+		},
+		cli.StringFlag{
+			Name:  "password_file",
+			Usage: "read the password from the file.",
+		},
+		cli.StringFlag{
+			Name:  "password_env",
+			Usage: "read the password from the environment variable with the given name.",
+		},
+	}
+}
+
+// hasPasswordOption reports whether the password is provided by one of the
+// password flags.
+func hasPasswordOption(c *cli.Context) bool {
+	return c.IsSet("password_stdin") || c.IsSet("password_file") || c.IsSet("password_env")
+}
+
+// readPassword returns the password provided by the password flags, or
+// prompts for it if none is given.
+func readPassword(c *cli.Context, prompt string) (string, error) {
+	n := 0
+	for _, name := range []string{"password_stdin", "password_file", "password_env"} {
+		if c.IsSet(name) {
+			n++
+		}
+	}
+	if n > 1 {
+		return "", argError("only one of -password_stdin, -password_file and -password_env can be set")
+	}
+	switch {
+	case c.IsSet("password_stdin"):
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("cannot read password from standard input: %s", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	case c.IsSet("password_file"):
+		b, err := ioutil.ReadFile(c.String("password_file"))
+		if err != nil {
+			return "", argError("cannot read password file: %s", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case c.IsSet("password_env"):
+		p, ok := os.LookupEnv(c.String("password_env"))
+		if !ok {
+			return "", argError("environment variable %s is not set", c.String("password_env"))
+		}
+		return p, nil
+	}
+	fmt.Print(prompt)
+	return string(gopass.GetPasswd()), nil
+}
+
+// passwordPolicy is the policy enforced on the new passwords before they are
+// hashed or sent to the server.
+type passwordPolicy struct {
+	minLength int
+	// Minimum number of character classes among lowercase letters, uppercase
+	// letters, digits and symbols.
+	minClasses int
+	// Whether the password may contain the email address or its local part.
+	allowEmail bool
+	// Breached password list, or nil if none.
+	breached *breachedList
+}
+
+var policy = passwordPolicy{minLength: 8}
+
+// characterClasses returns the number of character classes in the password.
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// check returns an invalid argument error if the password of the user with
+// the email address violates the policy.
+func (p *passwordPolicy) check(password, email string) error {
+	if n := len([]rune(password)); n < p.minLength {
+		return argError("password must have at least %d characters", p.minLength)
+	}
+	if characterClasses(password) < p.minClasses {
+		return argError("password must contain at least %d of lowercase letters, uppercase letters, digits and symbols", p.minClasses)
+	}
+	if !p.allowEmail && email != "" {
+		lp := strings.ToLower(password)
+		local := strings.ToLower(email)
+		if i := strings.LastIndex(local, "@"); i >= 0 {
+			local = local[:i]
+		}
+		if strings.Contains(lp, strings.ToLower(email)) || (len(local) >= 3 && strings.Contains(lp, local)) {
+			return argError("password must not contain the email address")
+		}
+	}
+	if p.breached != nil {
+		breached, err := p.breached.contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			return argError("password appears in the breached password list")
+		}
+	}
+	return nil
+}
+
+// breachedList is the list of the SHA-1 hashes of breached passwords. The list
+// is either a directory of k-anonymity range files, each named after the first
+// 5 hex digits of the hashes and listing the remaining 35 digits of one hash
+// per line, or a single file listing the full hashes. In both formats a line
+// may be followed by ":COUNT", which is ignored.
+//
+// A single file is loaded in memory on first use, so that it is read once per
+// run instead of once per password. Use the directory format for lists too
+// large to fit in memory.
+type breachedList struct {
+	path string
+
+	once sync.Once
+	err  error
+	dir  bool
+	// Sorted hashes of the single file list.
+	hashes [][sha1.Size]byte
+}
+
+// breachedHash returns the hash of a line of the list.
+func breachedHash(line string) string {
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+// load reads the single file list, or only checks the directory.
+func (l *breachedList) load() {
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		l.err = err
+		return
+	}
+	if l.dir = fi.IsDir(); l.dir {
+		return
+	}
+	f, err := os.Open(l.path)
+	if err != nil {
+		l.err = err
+		return
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var h [sha1.Size]byte
+		if line := breachedHash(s.Text()); len(line) == hex.EncodedLen(sha1.Size) {
+			if _, err := hex.Decode(h[:], []byte(line)); err == nil {
+				l.hashes = append(l.hashes, h)
+			}
+		}
+	}
+	if l.err = s.Err(); l.err != nil {
+		return
+	}
+	sort.Slice(l.hashes, func(i, j int) bool {
+		return bytes.Compare(l.hashes[i][:], l.hashes[j][:]) < 0
+	})
+}
+
+// contains looks up the SHA-1 hash of the password in the list.
+func (l *breachedList) contains(password string) (bool, error) {
+	l.once.Do(l.load)
+	if l.err != nil {
+		return false, l.err
+	}
+	sum := sha1.Sum([]byte(password))
+	if !l.dir {
+		i := sort.Search(len(l.hashes), func(i int) bool {
+			return bytes.Compare(l.hashes[i][:], sum[:]) >= 0
+		})
+		return i < len(l.hashes) && l.hashes[i] == sum, nil
+	}
+	h := strings.ToUpper(hex.EncodeToString(sum[:]))
+	path := filepath.Join(l.path, h[:5])
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		path += ".txt"
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// No breached hash with the prefix.
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if strings.EqualFold(breachedHash(s.Text()), h[5:]) {
+			return true, nil
+		}
+	}
+	return false, s.Err()
+}
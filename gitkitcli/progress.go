@@ -0,0 +1,139 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// quiet disables the progress reporting.
+var quiet bool
+
+// Intervals between two progress updates on a terminal and in the log.
+const (
+	progressTTYInterval = 200 * time.Millisecond
+	progressLogInterval = 10 * time.Second
+)
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// progress reports the progress of a bulk command on standard error. On a
+// terminal the status line is redrawn in place, otherwise it is logged
+// periodically.
+type progress struct {
+	name     string
+	disabled bool
+	tty      bool
+	start    time.Time
+	last     time.Time
+	done     int
+	failed   int
+	// Size of the input in bytes and the number of bytes consumed so far, used
+	// to estimate the remaining time. size is 0 if unknown.
+	size int64
+	pos  *countingReader
+}
+
+// newProgress creates the progress reporter for the named command. in is the
+// input being processed and size its total size, or nil and 0 if unknown.
+func newProgress(name string, in *countingReader, size int64) *progress {
+	now := time.Now()
+	return &progress{
+		name:     name,
+		disabled: quiet,
+		tty:      term.IsTerminal(int(os.Stderr.Fd())),
+		start:    now,
+		last:     now,
+		size:     size,
+		pos:      in,
+	}
+}
+
+// add records n more processed records, failed of which failed.
+func (p *progress) add(n, failed int) {
+	p.done += n
+	p.failed += failed
+	interval := progressLogInterval
+	if p.tty {
+		interval = progressTTYInterval
+	}
+	if now := time.Now(); now.Sub(p.last) >= interval {
+		p.last = now
+		p.report()
+	}
+}
+
+// printf prints a message about a record on standard output. On a terminal
+// the status line is cleared first, so that the message is not appended to it.
+// The status is redrawn at the next update.
+func (p *progress) printf(format string, a ...interface{}) {
+	if p.tty && !p.disabled {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+	fmt.Printf(format, a...)
+}
+
+// finish prints the final status.
+func (p *progress) finish() {
+	p.report()
+	if p.tty && !p.disabled {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func (p *progress) status() string {
+	elapsed := time.Since(p.start)
+	s := fmt.Sprintf("%s: %d users processed, %d failed", p.name, p.done, p.failed)
+	if secs := elapsed.Seconds(); secs > 0 {
+		s += fmt.Sprintf(", %.1f users/s", float64(p.done)/secs)
+	}
+	if p.size > 0 && p.pos != nil && p.pos.n > 0 {
+		ratio := float64(p.pos.n) / float64(p.size)
+		if ratio > 1 {
+			ratio = 1
+		}
+		eta := time.Duration(float64(elapsed) * (1 - ratio) / ratio)
+		s += fmt.Sprintf(", %.0f%%, ETA %s", ratio*100, eta/time.Second*time.Second)
+	}
+	return s
+}
+
+func (p *progress) report() {
+	if p.disabled {
+		return
+	}
+	if p.tty {
+		// Clear the rest of the line in case the new status is shorter.
+		fmt.Fprintf(os.Stderr, "\r%s\033[K", p.status())
+	} else {
+		log.Print(p.status())
+	}
+}
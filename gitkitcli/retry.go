@@ -0,0 +1,268 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+// verbose controls whether the verbose logs are printed.
+var verbose bool
+
+// logVerbose prints the log only in verbose mode.
+func logVerbose(format string, v ...interface{}) {
+	if verbose {
+		log.Printf(format, v...)
+	}
+}
+
+// retryPolicy describes how the failed API calls are retried.
+type retryPolicy struct {
+	// Maximum number of attempts, including the first one.
+	attempts int
+	// Delay before the first retry. It doubles for each following retry.
+	initialDelay time.Duration
+	// Upper bound of the delay between two attempts.
+	maxDelay time.Duration
+}
+
+var retry = retryPolicy{
+	attempts:     5,
+	initialDelay: 500 * time.Millisecond,
+	maxDelay:     30 * time.Second,
+}
+
+// isRetryable reports whether the failed call could succeed if retried, i.e.
+// the error is a rate limit, server side or network error. Failures to obtain
+// an access token are reported as URL errors too, but are not retried.
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case *gitkit.APIError:
+		return e.Code == 429 || e.Code >= 500
+	case *url.Error:
+		return exitCode(e) != exitAuth
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+// backoff returns the delay before the nth retry, which grows exponentially
+// with a random jitter of up to half of the delay. There is no delay if the
+// initial delay is zero.
+func (p *retryPolicy) backoff(n int) time.Duration {
+	if p.initialDelay <= 0 {
+		return 0
+	}
+	d := p.initialDelay << uint(n)
+	// The shift overflows if it drops bits of the initial delay.
+	if n >= 63 || d>>uint(n) != p.initialDelay || d > p.maxDelay {
+		d = p.maxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// wait sleeps before the nth retry of the named call. It returns false if the
+// context is done before that.
+func (p *retryPolicy) wait(ctx context.Context, name string, n int, err error) bool {
+	d := p.backoff(n)
+	logVerbose("%s failed: %s. Retry %d/%d in %s", name, err, n+1, p.attempts-1, d)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// do calls f until it succeeds, fails with a non-retryable error or the
+// attempts are exhausted. Each attempt is bounded by the -timeout flag.
+func (p *retryPolicy) do(ctx context.Context, name string, f func(context.Context) error) error {
+	for n := 0; ; n++ {
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			actx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		err := f(actx)
+		cancel()
+		if err == nil || !isRetryable(err) || n+1 >= p.attempts || !p.wait(ctx, name, n, err) {
+			return err
+		}
+	}
+}
+
+// retryingClient wraps gitkit.Client and retries the failed API calls
+// according to the retry policy.
+type retryingClient struct {
+	*gitkit.Client
+	policy *retryPolicy
+	// Authorized client for the calls not made by gitkit.Client.
+	hc *http.Client
+}
+
+func (c *retryingClient) ValidateToken(ctx context.Context, token, clientID string) (*gitkit.Token, error) {
+	var t *gitkit.Token
+	err := c.policy.do(ctx, "ValidateToken", func(ctx context.Context) (err error) {
+		t, err = c.Client.ValidateToken(ctx, token, clientID)
+		return
+	})
+	return t, err
+}
+
+func (c *retryingClient) UserByToken(ctx context.Context, token, clientID string) (*gitkit.User, error) {
+	var u *gitkit.User
+	err := c.policy.do(ctx, "UserByToken", func(ctx context.Context) (err error) {
+		u, err = c.Client.UserByToken(ctx, token, clientID)
+		return
+	})
+	return u, err
+}
+
+func (c *retryingClient) UserByEmail(ctx context.Context, email string) (*gitkit.User, error) {
+	var u *gitkit.User
+	err := c.policy.do(ctx, "UserByEmail", func(ctx context.Context) (err error) {
+		u, err = c.Client.UserByEmail(ctx, email)
+		return
+	})
+	return u, err
+}
+
+func (c *retryingClient) UserByLocalID(ctx context.Context, localID string) (*gitkit.User, error) {
+	var u *gitkit.User
+	err := c.policy.do(ctx, "UserByLocalID", func(ctx context.Context) (err error) {
+		u, err = c.Client.UserByLocalID(ctx, localID)
+		return
+	})
+	return u, err
+}
+
+func (c *retryingClient) UpdateUser(ctx context.Context, user *gitkit.User) error {
+	if dryRun {
+		return printDryRun("UpdateUser", &setAccountInfoRequest{
+			LocalID:       user.LocalID,
+			Email:         user.Email,
+			DisplayName:   user.DisplayName,
+			Password:      user.Password,
+			EmailVerified: &user.EmailVerified,
+		})
+	}
+	return c.policy.do(ctx, "UpdateUser", func(ctx context.Context) error {
+		return c.Client.UpdateUser(ctx, user)
+	})
+}
+
+func (c *retryingClient) DeleteUser(ctx context.Context, user *gitkit.User) error {
+	if dryRun {
+		return printDryRun("DeleteUser", &gitkit.User{LocalID: user.LocalID})
+	}
+	return c.policy.do(ctx, "DeleteUser", func(ctx context.Context) error {
+		return c.Client.DeleteUser(ctx, user)
+	})
+}
+
+func (c *retryingClient) UploadUsers(ctx context.Context, users []*gitkit.User, algorithm string, key, saltSeparator []byte) error {
+	if dryRun {
+		return printDryRun("UploadUsers", &uploadPayload{algorithm, key, saltSeparator, users})
+	}
+	return c.policy.do(ctx, "UploadUsers", func(ctx context.Context) error {
+		return c.Client.UploadUsers(ctx, users, algorithm, key, saltSeparator)
+	})
+}
+
+// generateOOBCode obtains the OOB code of the action for the user with the
+// per-action call of the client. newEmail and idToken are only used by the
+// change email action.
+func (c *retryingClient) generateOOBCode(ctx context.Context, action gitkit.OOBAction, email, newEmail, idToken string) (*gitkit.OOBCodeResponse, error) {
+	// The request only gives the IP address of the end user, which is the
+	// local host for the command line tool.
+	req := &http.Request{RemoteAddr: "127.0.0.1:0"}
+	var resp *gitkit.OOBCodeResponse
+	err := c.policy.do(ctx, "GenerateOOBCode", func(ctx context.Context) (err error) {
+		switch action {
+		case gitkit.OOBActionResetPassword:
+			resp, err = c.Client.GenerateResetPasswordOOBCode(ctx, req, email, "", "")
+		case gitkit.OOBActionChangeEmail:
+			resp, err = c.Client.GenerateChangeEmailOOBCode(ctx, req, email, newEmail, idToken)
+		default:
+			resp, err = c.Client.GenerateEmailVerificationOOBCode(ctx, req, email)
+		}
+		return
+	})
+	return resp, err
+}
+
+// listUsers downloads all the user accounts and calls f for each of them. The
+// listing is resumed from where it failed according to the retry policy. As
+// the pages are fetched by the client in the background, the -timeout flag
+// bounds the wait for the next user, which covers each page fetch.
+func (c *retryingClient) listUsers(ctx context.Context, f func(*gitkit.User) error) error {
+	var l *gitkit.UserList
+	for n := 0; ; n++ {
+		lctx, cancel := context.WithCancel(ctx)
+		if l == nil {
+			l = c.Client.ListUsers(lctx)
+		} else {
+			l.Retry(lctx)
+		}
+		err := c.receiveUsers(l, cancel, f)
+		cancel()
+		if err == nil {
+			err = l.Error
+		}
+		if err == nil || !isRetryable(err) || n+1 >= c.policy.attempts || !c.policy.wait(ctx, "ListUsers", n, err) {
+			return err
+		}
+	}
+}
+
+// receiveUsers calls f for each user received from the listing until it ends.
+// If no user is received within the timeout, the listing is canceled and
+// context.DeadlineExceeded is returned once the users already fetched are
+// received.
+func (c *retryingClient) receiveUsers(l *gitkit.UserList, cancel context.CancelFunc, f func(*gitkit.User) error) error {
+	var err error
+	for {
+		var t *time.Timer
+		var deadline <-chan time.Time
+		if timeout > 0 && err == nil {
+			t = time.NewTimer(timeout)
+			deadline = t.C
+		}
+		select {
+		case u, ok := <-l.C:
+			if t != nil {
+				t.Stop()
+			}
+			if !ok {
+				return err
+			}
+			if err := f(u); err != nil {
+				return err
+			}
+		case <-deadline:
+			err = context.DeadlineExceeded
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+// seedUser generates the i-th synthetic user of the run, with a random name,
+// and its password hashed with the algorithm.
+func seedUser(run string, i int, domain, password, algorithm string, key []byte, verifiedRatio float64) (*gitkit.User, error) {
+	b, err := randomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	first, last := fakeName(b)
+	// The run token and the index make the email address unique across runs.
+	u := &gitkit.User{
+		Email:         fmt.Sprintf("%s.%s.%s.%d@%s", first, last, run, i, domain),
+		DisplayName:   strings.ToUpper(first[:1]) + first[1:] + " " + strings.ToUpper(last[:1]) + last[1:],
+		EmailVerified: float64(binary.BigEndian.Uint32(b[4:]))/(1<<32) < verifiedRatio,
+		Salt:          b[8:],
+	}
+	if u.PasswordHash, err = hashPassword(algorithm, password, u.Salt, key); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// cleanupSeeded deletes the users listed in the manifest, and removes the
+// manifest if all of them are deleted.
+func cleanupSeeded(c *cli.Context, manifest string) {
+	f, err := os.Open(manifest)
+	if err != nil {
+		failOnError(c, argError("cannot read manifest: %s", err))
+	}
+	var ids []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if id := strings.TrimSpace(s.Text()); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	f.Close()
+	failOnError(c, s.Err())
+	p := newProgress(c.Command.Name, nil, 0)
+	deleted, missing := 0, 0
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			p.finish()
+			fmt.Printf(">> interrupted, %d users %s\n", deleted, wouldBe("deleted"))
+			failOnError(c, ctx.Err())
+		}
+		err := client.DeleteUser(ctx, &gitkit.User{LocalID: id})
+		if err != nil && exitCode(err) == exitUserNotFound {
+			missing++
+		} else if err != nil {
+			p.finish()
+			fmt.Printf(">> failed to delete user %s, %d users %s\n", id, deleted, wouldBe("deleted"))
+			failOnError(c, err)
+		} else {
+			deleted++
+		}
+		p.add(1, 0)
+	}
+	p.finish()
+	if !dryRun {
+		failOnError(c, os.Remove(manifest))
+	}
+	fmt.Printf(">> %d users %s, %d already gone\n", deleted, wouldBe("deleted"), missing)
+	fmt.Println(">> done")
+}
+
+func commandSeedUsers() cli.Command {
+	return cli.Command{
+		Name:  "seedusers",
+		Usage: "seedusers [Options]",
+		Description: "Generate synthetic users for load tests and upload them, or write them to a file with -output. " +
+			"The local IDs of the uploaded users are appended to the manifest, which -cleanup reads to delete them.",
+		Flags: []cli.Flag{
+			cli.IntFlag{
+				Name:  "count",
+				Usage: "the number of users to generate.",
+			},
+			cli.StringFlag{
+				Name:  "domain",
+				Value: "example.test",
+				Usage: "the domain of the email addresses.",
+			},
+			cli.StringFlag{
+				Name:  "password",
+				Usage: "the password of all generated users.",
+			},
+			cli.Float64Flag{
+				Name:  "verified_ratio",
+				Value: 0.8,
+				Usage: "the ratio of the users whose email address is verified.",
+			},
+			cli.StringFlag{
+				Name:  "algorithm",
+				Value: "HMAC_SHA1",
+				Usage: "the algorithm name for hashing password.",
+			},
+			cli.StringFlag{
+				Name:  "hash_key",
+				Usage: "URL safe base64 encoded hash key. Default to a random key.",
+			},
+			localIDStrategyFlag("prefix:seed"),
+			cli.StringFlag{
+				Name:  "output",
+				Usage: "the file to write the users to instead of uploading them.",
+			},
+			cli.StringFlag{
+				Name:  "manifest",
+				Value: "seedusers.manifest",
+				Usage: "the file recording the local IDs of the uploaded users.",
+			},
+			cli.BoolFlag{
+				Name:  "cleanup",
+				Usage: "delete the users recorded in the manifest instead of generating users.",
+			},
+		},
+		Action: func(c *cli.Context) {
+			failOnError(c, checkZeroArgument(c))
+			if c.Bool("cleanup") {
+				failOnError(c, initClient(c))
+				cleanupSeeded(c, c.String("manifest"))
+				return
+			}
+			if c.Int("count") <= 0 {
+				failOnError(c, argError("-count must be positive"))
+			}
+			if !c.IsSet("password") {
+				failOnError(c, argError("-password is required"))
+			}
+			if r := c.Float64("verified_ratio"); r < 0 || r > 1 {
+				failOnError(c, argError("-verified_ratio must be between 0 and 1"))
+			}
+			key, err := base64.URLEncoding.DecodeString(c.String("hash_key"))
+			failOnError(c, err)
+			if !c.IsSet("hash_key") {
+				key, err = randomBytes(32)
+				failOnError(c, err)
+			}
+			algorithm := c.String("algorithm")
+			// The IDs are not checked against the existing accounts, as it
+			// takes one call per user.
+			ids, err := newLocalIDGenerator(c.String("local_id_strategy"), nil)
+			failOnError(c, err)
+			b, err := randomBytes(4)
+			failOnError(c, err)
+			run := hex.EncodeToString(b)
+			generate := func(i int) *gitkit.User {
+				u, err := seedUser(run, i, c.String("domain"), c.String("password"), algorithm, key, c.Float64("verified_ratio"))
+				failOnError(c, err)
+				return u
+			}
+			if c.IsSet("output") {
+				f, err := os.OpenFile(c.String("output"), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, os.FileMode(0600))
+				failOnError(c, err)
+				defer f.Close()
+				p := newProgress(c.Command.Name, nil, 0)
+				for i := 0; i < c.Int("count"); i++ {
+					u := generate(i)
+					failOnError(c, ids.assign(u))
+					b, err := json.MarshalIndent(u, "", "  ")
+					failOnError(c, err)
+					_, err = fmt.Fprintln(f, string(b))
+					failOnError(c, err)
+					p.add(1, 0)
+				}
+				p.finish()
+				fmt.Printf(">> upload with -algorithm=%s -hash_key=%s\n", algorithm, base64.URLEncoding.EncodeToString(key))
+				fmt.Println(">> done")
+				return
+			}
+			// The client is not needed to write the users to a file.
+			failOnError(c, initClient(c))
+			// Nothing is uploaded, so recorded, in dry run mode.
+			var m *os.File
+			if !dryRun {
+				m, err = os.OpenFile(c.String("manifest"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.FileMode(0600))
+				failOnError(c, err)
+				defer m.Close()
+			}
+			up := &uploader{
+				c:        c,
+				defaults: hashOptions{algorithm: algorithm, key: string(key)},
+				ids:      ids,
+				onUpload: func(u *gitkit.User) error {
+					_, err := fmt.Fprintln(m, u.LocalID)
+					return err
+				},
+				p: newProgress(c.Command.Name, nil, 0),
+			}
+			for i := 0; i < c.Int("count"); i += uploadBatchSize {
+				var records []*userRecord
+				for j := i; j < i+uploadBatchSize && j < c.Int("count"); j++ {
+					records = append(records, &userRecord{User: generate(j)})
+				}
+				up.add(records)
+				if ctx.Err() != nil {
+					up.flush()
+					up.p.finish()
+					fmt.Printf(">> interrupted after batch %d, %d users %s\n", up.batch, up.processed-up.failed, wouldBe("seeded"))
+					failOnError(c, ctx.Err())
+				}
+			}
+			up.flush()
+			up.p.finish()
+			if dryRun {
+				fmt.Printf(">> %d users would be seeded\n", up.processed-up.failed)
+			} else {
+				fmt.Printf(">> %d users seeded, recorded in %s\n", up.processed-up.failed, c.String("manifest"))
+			}
+			fmt.Println(">> done")
+			if up.failed > 0 {
+				failOnError(c, &cliError{exitPartialUpload, fmt.Errorf("failed to upload %d users", up.failed)})
+			}
+		},
+	}
+}
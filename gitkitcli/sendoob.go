@@ -0,0 +1,272 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+// OOB actions accepted by the sendoob command, mapped to the actions of the
+// client.
+var oobActions = map[string]gitkit.OOBAction{
+	"reset_password": gitkit.OOBActionResetPassword,
+	"verify_email":   gitkit.OOBActionVerifyEmail,
+	"change_email":   gitkit.OOBActionChangeEmail,
+}
+
+// Email templates.
+const (
+	emailTemplateResetPassword = `Dear user,
+
+A request was received to reset the password for your account %[1]s.
+To reset your password, open the link below in your browser:
+
+%[2]s
+`
+
+	emailTemplateChangeEmail = `Dear user,
+
+A request was received to change your account email address from %[1]s to %[2]s.
+To change your account email address, open the link below in your browser:
+
+%[3]s
+`
+
+	emailTemplateVerifyEmail = `Dear user,
+
+To verify your account email address %[1]s, open the link below in your browser:
+
+%[2]s
+`
+)
+
+// smtpConfig holds the settings for delivering OOB emails through an SMTP
+// server.
+type smtpConfig struct {
+	server   string
+	user     string
+	password string
+	sender   string
+}
+
+// oobMessage composes the email message for the OOB code response.
+func oobMessage(resp *gitkit.OOBCodeResponse) (to, subject, body string) {
+	link := resp.OOBCodeURL.String()
+	switch resp.Action {
+	case gitkit.OOBActionResetPassword:
+		return resp.Email, "Reset your account password", fmt.Sprintf(emailTemplateResetPassword, resp.Email, link)
+	case gitkit.OOBActionChangeEmail:
+		return resp.NewEmail, "Account email address change confirmation", fmt.Sprintf(emailTemplateChangeEmail, resp.Email, resp.NewEmail, link)
+	default:
+		return resp.Email, "Account email address verification", fmt.Sprintf(emailTemplateVerifyEmail, resp.Email, link)
+	}
+}
+
+// oobEmail describes the OOB email which is not sent in dry run mode. The body
+// is left out as the link contains the OOB code.
+type oobEmail struct {
+	Server  string `json:"server"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+}
+
+// sendOOBEmail delivers the OOB link in resp through the SMTP server. In dry
+// run mode, the email is described on out instead.
+func sendOOBEmail(out io.Writer, s *smtpConfig, resp *gitkit.OOBCodeResponse) error {
+	to, subject, body := oobMessage(resp)
+	if dryRun {
+		return fprintDryRun(out, "SendMail", &oobEmail{s.server, s.sender, to, subject})
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", s.sender)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(body)
+	var auth smtp.Auth
+	if s.user != "" {
+		host, _, err := net.SplitHostPort(s.server)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.user, s.password, host)
+	}
+	return smtp.SendMail(s.server, auth, s.sender, []string{to}, b.Bytes())
+}
+
+// readEmails reads the email addresses in the file, one per line. Blank lines
+// and lines starting with # are ignored.
+func readEmails(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var emails []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		emails = append(emails, line)
+	}
+	return emails, s.Err()
+}
+
+func commandSendOOB() cli.Command {
+	return cli.Command{
+		Name:  "sendoob",
+		Usage: "sendoob --action ACTION [Options] [EMAIL]",
+		Description: "Obtain the out-of-band action link for the user and print it or send it by email. " +
+			"ACTION is one of reset_password, verify_email and change_email.",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "action",
+				Usage: "the OOB action: reset_password, verify_email or change_email.",
+			},
+			cli.StringFlag{
+				Name:  "new_email",
+				Usage: "the new email address for the change_email action.",
+			},
+			cli.StringFlag{
+				Name:  "id_token",
+				Usage: "the ID token of the user, required by the change_email action.",
+			},
+			cli.StringFlag{
+				Name:  "input",
+				Usage: "the file of email addresses, one per line, to obtain links for in bulk.",
+			},
+			cli.StringFlag{
+				Name:  "output",
+				Usage: "the CSV file to write the bulk links to. If not specified or -, standard output is used.",
+			},
+			cli.StringFlag{
+				Name:  "smtp_server",
+				Usage: "the host:port of the SMTP server. If set, the links are sent by email instead of printed.",
+			},
+			cli.StringFlag{
+				Name:  "smtp_user",
+				Usage: "the user name for authenticating with the SMTP server.",
+			},
+			cli.StringFlag{
+				Name:   "smtp_password",
+				Usage:  "the password for authenticating with the SMTP server.",
+				EnvVar: "GITKIT_SMTP_PASSWORD",
+			},
+			cli.StringFlag{
+				Name:  "sender",
+				Usage: "the sender address of the emails.",
+			},
+		},
+		Action: func(c *cli.Context) {
+			action, ok := oobActions[c.String("action")]
+			if !ok {
+				failOnError(c, argError("-action must be one of reset_password, verify_email and change_email"))
+			}
+			var s *smtpConfig
+			if c.IsSet("smtp_server") {
+				if !c.IsSet("sender") {
+					failOnError(c, argError("-sender is required when -smtp_server is set"))
+				}
+				s = &smtpConfig{
+					server:   c.String("smtp_server"),
+					user:     c.String("smtp_user"),
+					password: c.String("smtp_password"),
+					sender:   c.String("sender"),
+				}
+			}
+			if c.IsSet("input") {
+				failOnError(c, checkZeroArgument(c))
+				if action == gitkit.OOBActionChangeEmail {
+					failOnError(c, argError("change_email is not supported in bulk mode"))
+				}
+				emails, err := readEmails(c.String("input"))
+				failOnError(c, err)
+				f := os.Stdout
+				if c.IsSet("output") && c.String("output") != "-" {
+					f, err = os.OpenFile(c.String("output"), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, os.FileMode(0600))
+					failOnError(c, err)
+					defer f.Close()
+				}
+				w := csv.NewWriter(f)
+				w.Write([]string{"email", "action", "link", "status"})
+				failed := 0
+				for i, email := range emails {
+					if ctx.Err() != nil {
+						w.Flush()
+						fmt.Fprintf(os.Stderr, ">> interrupted after %d of %d addresses, %d failed\n", i, len(emails), failed)
+						failOnError(c, ctx.Err())
+					}
+					link, status := "", "ok"
+					resp, err := client.generateOOBCode(ctx, action, email, "", "")
+					if err == nil {
+						link = resp.OOBCodeURL.String()
+						if s != nil {
+							// Standard output may hold the CSV.
+							err = sendOOBEmail(os.Stderr, s, resp)
+							if err == nil && dryRun {
+								status = "dry run"
+							} else if err == nil {
+								status = "sent"
+							}
+						}
+					}
+					if err != nil {
+						status = err.Error()
+						failed++
+					}
+					w.Write([]string{email, c.String("action"), link, status})
+				}
+				w.Flush()
+				failOnError(c, w.Error())
+				if failed > 0 {
+					failOnError(c, &cliError{exitPartialUpload, fmt.Errorf("failed for %d of %d addresses", failed, len(emails))})
+				}
+				return
+			}
+			failOnError(c, checkOneArgument(c))
+			email := c.Args().First()
+			if action == gitkit.OOBActionChangeEmail && (!c.IsSet("new_email") || !c.IsSet("id_token")) {
+				failOnError(c, argError("-new_email and -id_token are required by change_email"))
+			}
+			resp, err := client.generateOOBCode(ctx, action, email, c.String("new_email"), c.String("id_token"))
+			failOnError(c, err)
+			if s != nil {
+				failOnError(c, sendOOBEmail(os.Stdout, s, resp))
+				if dryRun {
+					return
+				}
+				to, _, _ := oobMessage(resp)
+				fmt.Printf(">> %s link sent to %s\n", c.String("action"), to)
+				return
+			}
+			fmt.Printf(">> %s link for %s:\n", c.String("action"), email)
+			fmt.Println(resp.OOBCodeURL.String())
+		},
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+// shardIndexFile is the name of the index file in the shard directory.
+const shardIndexFile = "index.json"
+
+// shardInfo describes one shard file of the downloaded users.
+type shardInfo struct {
+	Name string `json:"name"`
+	// Range of the records in the shard, starting from 1.
+	FirstRecord int `json:"firstRecord"`
+	LastRecord  int `json:"lastRecord"`
+	// Uncompressed size of the shard in bytes.
+	Size int64 `json:"size"`
+	// SHA-256 checksum of the shard file, hex encoded.
+	SHA256 string `json:"sha256"`
+}
+
+// shardIndex lists the shards in the order they were written.
+type shardIndex struct {
+	Gzip   bool        `json:"gzip"`
+	Shards []shardInfo `json:"shards"`
+}
+
+// shardWriter writes the users into numbered shard files in a directory and
+// rotates to a new shard when the record or byte limit is reached.
+type shardWriter struct {
+	dir        string
+	gzip       bool
+	maxRecords int
+	maxBytes   int64
+	index      shardIndex
+	records    int
+
+	// The shard being written.
+	f    *os.File
+	gz   *gzip.Writer
+	w    io.Writer
+	h    hash.Hash
+	info *shardInfo
+}
+
+// newShardWriter creates the shard writer. A limit of 0 means no limit.
+func newShardWriter(dir string, maxRecords int, maxBytes int64, compress bool) (*shardWriter, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &shardWriter{
+		dir:        dir,
+		gzip:       compress,
+		maxRecords: maxRecords,
+		maxBytes:   maxBytes,
+		index:      shardIndex{Gzip: compress},
+	}, nil
+}
+
+func (w *shardWriter) open() error {
+	name := fmt.Sprintf("users-%05d.json", len(w.index.Shards))
+	if w.gzip {
+		name += ".gz"
+	}
+	f, err := os.OpenFile(filepath.Join(w.dir, name), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, os.FileMode(0600))
+	if err != nil {
+		return err
+	}
+	w.f = f
+	w.h = sha256.New()
+	w.w = io.MultiWriter(f, w.h)
+	if w.gzip {
+		w.gz = gzip.NewWriter(w.w)
+		w.w = w.gz
+	}
+	w.info = &shardInfo{Name: name, FirstRecord: w.records + 1}
+	return nil
+}
+
+func (w *shardWriter) closeShard() error {
+	if w.f == nil {
+		return nil
+	}
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			return err
+		}
+		w.gz = nil
+	}
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	w.f = nil
+	w.info.LastRecord = w.records
+	w.info.SHA256 = hex.EncodeToString(w.h.Sum(nil))
+	w.index.Shards = append(w.index.Shards, *w.info)
+	return nil
+}
+
+// write appends the user to the current shard, starting a new one if the
+// record would exceed a limit. A record larger than the byte limit gets a
+// shard of its own.
+func (w *shardWriter) write(u *gitkit.User) error {
+	b, err := json.MarshalIndent(u, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	// An open shard holds at least one record.
+	if w.f != nil && ((w.maxRecords > 0 && w.records-w.info.FirstRecord+1 >= w.maxRecords) ||
+		(w.maxBytes > 0 && w.info.Size+int64(len(b)) > w.maxBytes)) {
+		if err := w.closeShard(); err != nil {
+			return err
+		}
+	}
+	if w.f == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	n, err := w.w.Write(b)
+	w.info.Size += int64(n)
+	w.records++
+	return err
+}
+
+// close finishes the current shard and writes the index file.
+func (w *shardWriter) close() error {
+	if err := w.closeShard(); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(&w.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(w.dir, shardIndexFile), b, 0600)
+}
+
+// checkShard verifies the SHA-256 checksum of the shard file.
+func checkShard(dir string, s shardInfo) error {
+	f, err := os.Open(filepath.Join(dir, s.Name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != s.SHA256 {
+		return fmt.Errorf("checksum mismatch for shard %s", s.Name)
+	}
+	return nil
+}
+
+// shardReader reads the users from the shards in a directory in order.
+type shardReader struct {
+	dir    string
+	index  shardIndex
+	next   int
+	f      *os.File
+	r      io.Reader
+	closer io.Closer
+}
+
+// openShards opens the shard directory written by downloadusers. It returns
+// the reader of the concatenated users and their total uncompressed size. The
+// checksums of all shards are verified first, so that nothing is uploaded
+// from a corrupted directory.
+func openShards(dir string) (io.ReadCloser, int64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, shardIndexFile))
+	if err != nil {
+		return nil, 0, err
+	}
+	r := &shardReader{dir: dir}
+	if err := json.Unmarshal(b, &r.index); err != nil {
+		return nil, 0, fmt.Errorf("invalid shard index: %s", err)
+	}
+	var size int64
+	for _, s := range r.index.Shards {
+		if err := checkShard(dir, s); err != nil {
+			return nil, 0, err
+		}
+		size += s.Size
+	}
+	return r, size, nil
+}
+
+func (r *shardReader) Read(p []byte) (int, error) {
+	for {
+		if r.r == nil {
+			if r.next >= len(r.index.Shards) {
+				return 0, io.EOF
+			}
+			if err := r.openNext(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.r.Read(p)
+		if err == io.EOF {
+			r.closeCurrent()
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *shardReader) openNext() error {
+	s := r.index.Shards[r.next]
+	r.next++
+	f, err := os.Open(filepath.Join(r.dir, s.Name))
+	if err != nil {
+		return err
+	}
+	r.f = f
+	var in io.Reader = f
+	if r.index.Gzip {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		r.closer = gz
+		in = gz
+	}
+	r.r = in
+	return nil
+}
+
+func (r *shardReader) closeCurrent() {
+	if r.closer != nil {
+		r.closer.Close()
+		r.closer = nil
+	}
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+	r.r = nil
+}
+
+func (r *shardReader) Close() error {
+	r.closeCurrent()
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+// writeShards writes the users into a new temporary shard directory.
+func writeShards(t *testing.T, users []*gitkit.User, maxRecords int, maxBytes int64, compress bool) string {
+	dir, err := ioutil.TempDir("", "shards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newShardWriter(dir, maxRecords, maxBytes, compress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range users {
+		if err := w.write(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func readIndex(t *testing.T, dir string) shardIndex {
+	b, err := ioutil.ReadFile(filepath.Join(dir, shardIndexFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index shardIndex
+	if err := json.Unmarshal(b, &index); err != nil {
+		t.Fatal(err)
+	}
+	return index
+}
+
+func TestShardRoundTrip(t *testing.T) {
+	var users []*gitkit.User
+	for i := 0; i < 10; i++ {
+		users = append(users, &gitkit.User{
+			LocalID:       fmt.Sprint(i),
+			Email:         fmt.Sprintf("user%d@example.com", i),
+			EmailVerified: i%2 == 0,
+		})
+	}
+	// One user is larger than the byte limit.
+	users[4].DisplayName = strings.Repeat("x", 300)
+	tests := []struct {
+		maxRecords int
+		maxBytes   int64
+		compress   bool
+	}{
+		{0, 0, false},
+		{3, 0, false},
+		{0, 200, false},
+		{0, 200, true},
+		{2, 200, true},
+	}
+	for _, tt := range tests {
+		dir := writeShards(t, users, tt.maxRecords, tt.maxBytes, tt.compress)
+		defer os.RemoveAll(dir)
+		index := readIndex(t, dir)
+		if index.Gzip != tt.compress {
+			t.Errorf("%+v: index gzip = %v", tt, index.Gzip)
+		}
+		next := 1
+		for _, s := range index.Shards {
+			n := s.LastRecord - s.FirstRecord + 1
+			if s.FirstRecord != next || n < 1 {
+				t.Errorf("%+v: shard %s holds records %d to %d, want from %d", tt, s.Name, s.FirstRecord, s.LastRecord, next)
+			}
+			if tt.maxRecords > 0 && n > tt.maxRecords {
+				t.Errorf("%+v: shard %s holds %d records", tt, s.Name, n)
+			}
+			if tt.maxBytes > 0 && s.Size > tt.maxBytes && n > 1 {
+				t.Errorf("%+v: shard %s holds %d bytes in %d records", tt, s.Name, s.Size, n)
+			}
+			next = s.LastRecord + 1
+		}
+		if next != len(users)+1 {
+			t.Errorf("%+v: shards hold %d records, want %d", tt, next-1, len(users))
+		}
+
+		r, size, err := openShards(dir)
+		if err != nil {
+			t.Fatalf("%+v: openShards() failed: %s", tt, err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(b)) != size {
+			t.Errorf("%+v: openShards() size = %d, read %d bytes", tt, size, len(b))
+		}
+		var got []*gitkit.User
+		d := json.NewDecoder(strings.NewReader(string(b)))
+		for {
+			u := &gitkit.User{}
+			if err := d.Decode(u); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%+v: %s", tt, err)
+			}
+			got = append(got, u)
+		}
+		if !reflect.DeepEqual(got, users) {
+			t.Errorf("%+v: read users %v, want %v", tt, got, users)
+		}
+	}
+}
+
+func TestOpenShardsChecksum(t *testing.T) {
+	users := []*gitkit.User{
+		{LocalID: "1", Email: "user1@example.com"},
+		{LocalID: "2", Email: "user2@example.com"},
+	}
+	dir := writeShards(t, users, 1, 0, false)
+	defer os.RemoveAll(dir)
+	index := readIndex(t, dir)
+	if len(index.Shards) != 2 {
+		t.Fatalf("wrote %d shards, want 2", len(index.Shards))
+	}
+	// Corrupting the last shard fails before anything is read.
+	name := filepath.Join(dir, index.Shards[1].Name)
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = []byte(strings.Replace(string(b), "user2", "user3", 1))
+	if err := ioutil.WriteFile(name, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := openShards(dir); err == nil || !strings.Contains(err.Error(), index.Shards[1].Name) {
+		t.Errorf("openShards() error = %v, want a checksum mismatch for %s", err, index.Shards[1].Name)
+	}
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := openShards(dir); err == nil {
+		t.Error("openShards() succeeded with a missing shard")
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/google/identity-toolkit-go-client/gitkit"
+	// Pure Go driver, so that the tool builds without cgo.
+	_ "modernc.org/sqlite"
+)
+
+// The users table has one column per gitkit.User field, except the write-only
+// Password, plus the bookkeeping columns of the sync. synced_at is the time of
+// the last sync which saw the user, or which marked it deleted.
+const createUsersTable = `CREATE TABLE IF NOT EXISTS users (
+	local_id            TEXT PRIMARY KEY,
+	email               TEXT,
+	email_verified      INTEGER,
+	display_name        TEXT,
+	provider_user_info  TEXT,
+	photo_url           TEXT,
+	password_hash       BLOB,
+	salt                BLOB,
+	version             INTEGER,
+	password_updated_at REAL,
+	valid_since         INTEGER,
+	disabled            INTEGER,
+	provider_id         TEXT,
+	checksum            TEXT NOT NULL,
+	deleted             INTEGER NOT NULL DEFAULT 0,
+	synced_at           TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS users_email ON users (email);`
+
+const upsertUser = `INSERT OR REPLACE INTO users (
+	local_id, email, email_verified, display_name, provider_user_info, photo_url,
+	password_hash, salt, version, password_updated_at, valid_since, disabled,
+	provider_id, checksum, deleted, synced_at
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?)`
+
+// syncStats counts the changes made by a sync.
+type syncStats struct {
+	added, updated, unchanged, deleted int
+}
+
+// userChecksum returns the checksum of the user account used to detect the
+// changed rows.
+func userChecksum(u *gitkit.User) (string, error) {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// syncUser inserts or updates the row of the user if it is new or changed.
+func syncUser(tx *sql.Tx, u *gitkit.User, now time.Time, stats *syncStats) error {
+	if _, err := tx.Exec("INSERT INTO seen (local_id) VALUES (?)", u.LocalID); err != nil {
+		return err
+	}
+	sum, err := userChecksum(u)
+	if err != nil {
+		return err
+	}
+	var old string
+	var deleted bool
+	switch err := tx.QueryRow("SELECT checksum, deleted FROM users WHERE local_id = ?", u.LocalID).Scan(&old, &deleted); {
+	case err == sql.ErrNoRows:
+		stats.added++
+	case err != nil:
+		return err
+	case old == sum && !deleted:
+		stats.unchanged++
+		_, err := tx.Exec("UPDATE users SET synced_at = ? WHERE local_id = ?", now, u.LocalID)
+		return err
+	default:
+		stats.updated++
+	}
+	providers, err := json.Marshal(u.ProviderUserInfo)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(upsertUser, u.LocalID, u.Email, u.EmailVerified, u.DisplayName, string(providers), u.PhotoURL,
+		u.PasswordHash, u.Salt, u.Version, u.PasswordUpdateAt, u.ValidSince, u.Disabled,
+		u.ProviderID, sum, now)
+	return err
+}
+
+// syncUsers mirrors all the user accounts into the database. The users which
+// no longer exist are marked deleted. Nothing is changed if the download
+// fails.
+func syncUsers(db *sql.DB, p *progress) (*syncStats, error) {
+	if _, err := db.Exec(createUsersTable); err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("CREATE TEMP TABLE seen (local_id TEXT PRIMARY KEY)"); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	stats := &syncStats{}
+	err = client.listUsers(ctx, func(u *gitkit.User) error {
+		p.add(1, 0)
+		return syncUser(tx, u, now, stats)
+	})
+	if err != nil {
+		return nil, err
+	}
+	r, err := tx.Exec("UPDATE users SET deleted = 1, synced_at = ? WHERE deleted = 0 AND local_id NOT IN (SELECT local_id FROM seen)", now)
+	if err != nil {
+		return nil, err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	stats.deleted = int(n)
+	if _, err := tx.Exec("DROP TABLE seen"); err != nil {
+		return nil, err
+	}
+	return stats, tx.Commit()
+}
+
+func commandSync() cli.Command {
+	return cli.Command{
+		Name:  "sync",
+		Usage: "sync --db DB_FILE",
+		Description: "Mirror all user accounts into a table named users in a SQLite database. " +
+			"On subsequent runs, the changed users are updated and the vanished users are marked deleted.",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "db",
+				Usage: "the SQLite database file.",
+			},
+		},
+		Action: func(c *cli.Context) {
+			failOnError(c, checkZeroArgument(c))
+			if !c.IsSet("db") {
+				failOnError(c, argError("-db is required"))
+			}
+			db, err := sql.Open("sqlite", c.String("db"))
+			failOnError(c, err)
+			defer db.Close()
+			p := newProgress(c.Command.Name, nil, 0)
+			stats, err := syncUsers(db, p)
+			p.finish()
+			failOnError(c, err)
+			fmt.Printf(">> %d added, %d updated, %d unchanged, %d deleted\n", stats.added, stats.updated, stats.unchanged, stats.deleted)
+			fmt.Println(">> done")
+		},
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/codegangsta/cli"
+	"github.com/google/identity-toolkit-go-client/gitkit"
+)
+
+// Maximum number of users uploaded in one call.
+const uploadBatchSize = 20
+
+// hashOptions are the password hash options of an UploadUsers call. The key
+// and salt separator are kept as strings so that the options can be used as
+// map keys.
+type hashOptions struct {
+	algorithm string
+	key       string
+	separator string
+}
+
+// hashKeyEntry is an entry of the keys file, which maps key names to the URL
+// safe base64 encoded hash keys and salt separators:
+//
+//	{"legacy": {"hashKey": "...", "saltSeparator": "..."}}
+type hashKeyEntry struct {
+	HashKey       string `json:"hashKey"`
+	SaltSeparator string `json:"saltSeparator"`
+}
+
+// loadHashKeys reads and decodes the keys file.
+func loadHashKeys(path string) (map[string]hashOptions, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, argError("cannot read keys file: %s", err)
+	}
+	var entries map[string]*hashKeyEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, argError("invalid keys file: %s", err)
+	}
+	keys := make(map[string]hashOptions)
+	for name, e := range entries {
+		key, err := base64.URLEncoding.DecodeString(e.HashKey)
+		if err != nil {
+			return nil, argError("invalid hash key %s in keys file: %s", name, err)
+		}
+		separator, err := base64.URLEncoding.DecodeString(e.SaltSeparator)
+		if err != nil {
+			return nil, argError("invalid salt separator %s in keys file: %s", name, err)
+		}
+		keys[name] = hashOptions{key: string(key), separator: string(separator)}
+	}
+	return keys, nil
+}
+
+// pendingBatch holds the users waiting to be uploaded with the same hash
+// options, and the action taken for each of them.
+type pendingBatch struct {
+	users   []*gitkit.User
+	actions []string
+}
+
+// uploader uploads the users read by uploadusers and keeps the statistics of
+// the upload. The users are grouped by their hash options, and each group is
+// uploaded in batches.
+type uploader struct {
+	c *cli.Context
+	// Hash options of the users without hash metadata, with an empty
+	// algorithm if none is given.
+	defaults hashOptions
+	// Hash keys by name, from the keys file.
+	keys map[string]hashOptions
+	ids  *localIDGenerator
+	// Whether the email addresses are normalized before uploading.
+	normalize bool
+	// Conflict policy, or empty for not checking the existing accounts.
+	onConflict string
+	priority   map[string]bool
+	// Whether the uploaded users are fetched back and compared.
+	verify bool
+	// Called with each user uploaded successfully, if not nil.
+	onUpload func(u *gitkit.User) error
+	p        *progress
+
+	pending map[hashOptions]*pendingBatch
+	// Hash options of the pending batches in the order they were started.
+	order []hashOptions
+
+	batch     int
+	processed int
+	failed    int
+	// Number of uploaded users which differ from the input.
+	mismatched int
+}
+
+// reject reports the user which is not uploaded because of err. Only invalid
+// argument errors are tolerated.
+func (up *uploader) reject(u *gitkit.User, err error) {
+	if exitCode(err) != exitInvalidArgument {
+		up.p.finish()
+		failOnError(up.c, err)
+	}
+	up.p.printf(">> rejected user %s: %s\n", u.Email, err)
+	up.processed++
+	up.failed++
+	up.p.add(1, 1)
+}
+
+// hashOptions returns the hash options of the record.
+func (up *uploader) hashOptions(r *userRecord) (hashOptions, error) {
+	if r.HashAlgorithm == "" {
+		if r.HashKey != "" {
+			return hashOptions{}, argError("hash key %s given without hash algorithm", r.HashKey)
+		}
+		if up.defaults.algorithm == "" {
+			return hashOptions{}, argError("no hash algorithm given")
+		}
+		return up.defaults, nil
+	}
+	var h hashOptions
+	if r.HashKey != "" {
+		var ok bool
+		if h, ok = up.keys[r.HashKey]; !ok {
+			return hashOptions{}, argError("unknown hash key %s", r.HashKey)
+		}
+	}
+	h.algorithm = r.HashAlgorithm
+	return h, nil
+}
+
+// add prepares the users and adds them to the pending batch of their hash
+// options. A batch is uploaded as soon as it is full. If the program is
+// interrupted, add returns without processing the remaining users, so that the
+// caller can upload the pending batches and report the users processed.
+func (up *uploader) add(records []*userRecord) {
+	if up.pending == nil {
+		up.pending = make(map[hashOptions]*pendingBatch)
+	}
+	for _, r := range records {
+		if ctx.Err() != nil {
+			return
+		}
+		u := r.User
+		if r.err != nil {
+			up.reject(u, r.err)
+			continue
+		}
+		h, err := up.hashOptions(r)
+		if err != nil {
+			up.reject(u, err)
+			continue
+		}
+		if up.normalize {
+			email, err := normalizeEmail(u.Email)
+			if err != nil {
+				up.reject(u, err)
+				continue
+			}
+			u.Email = email
+		}
+		if u.LocalID == "" || up.ids.strategy == "from-field" {
+			if err := up.ids.assign(u); err != nil {
+				// The collision check was interrupted.
+				if ctx.Err() != nil {
+					return
+				}
+				up.reject(u, err)
+				continue
+			}
+		}
+		action := "uploaded"
+		if up.onConflict != "" {
+			resolved, a, err := resolveConflict(client, u, up.onConflict, up.priority)
+			if err != nil && ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				up.p.finish()
+				failOnError(up.c, err)
+			}
+			if resolved == nil {
+				up.p.printf(">> %s user %s\n", a, u.Email)
+				up.processed++
+				up.p.add(1, 0)
+				continue
+			}
+			u, action = resolved, a
+		}
+		b, ok := up.pending[h]
+		if !ok {
+			b = &pendingBatch{}
+			up.pending[h] = b
+			up.order = append(up.order, h)
+		}
+		b.users = append(b.users, u)
+		b.actions = append(b.actions, action)
+		if len(b.users) == uploadBatchSize {
+			up.upload(h)
+		}
+	}
+}
+
+// flush uploads all pending batches.
+func (up *uploader) flush() {
+	for len(up.order) > 0 {
+		up.upload(up.order[0])
+	}
+}
+
+// upload uploads the pending batch of the hash options in one call.
+func (up *uploader) upload(h hashOptions) {
+	b := up.pending[h]
+	delete(up.pending, h)
+	for i, o := range up.order {
+		if o == h {
+			up.order = append(up.order[:i], up.order[i+1:]...)
+			break
+		}
+	}
+	up.batch++
+	logVerbose("Uploading batch %d (%d users, algorithm %s)", up.batch, len(b.users), h.algorithm)
+	// The batch in flight is not canceled on interruption so that it is
+	// either fully uploaded or reported as failed.
+	err := client.UploadUsers(context.Background(), b.users, h.algorithm, []byte(h.key), []byte(h.separator))
+	failed := make(map[int]bool)
+	if uploadErr, ok := err.(gitkit.UploadError); ok {
+		for _, v := range uploadErr {
+			up.p.printf(">> failed to upload user %s: %s\n", b.users[v.Index].Email, v.Message)
+			failed[v.Index] = true
+		}
+	} else if err != nil {
+		up.p.finish()
+		fmt.Printf(">> failed to upload batch %d (%d users, algorithm %s)\n", up.batch, len(b.users), h.algorithm)
+		failOnError(up.c, err)
+	}
+	if up.onConflict != "" {
+		for i, u := range b.users {
+			if !failed[i] {
+				up.p.printf(">> %s user %s\n", reportedAction(b.actions[i]), u.Email)
+			}
+		}
+	}
+	for i, u := range b.users {
+		// Nothing is uploaded in dry run mode.
+		if failed[i] || dryRun {
+			continue
+		}
+		if up.onUpload != nil {
+			if err := up.onUpload(u); err != nil {
+				up.p.finish()
+				failOnError(up.c, err)
+			}
+		}
+		// The users are not fetched back once interrupted, only the
+		// pending batches are still uploaded.
+		if up.verify && ctx.Err() == nil {
+			up.check(u)
+		}
+	}
+	up.processed += len(b.users)
+	up.failed += len(failed)
+	up.p.add(len(b.users), len(failed))
+}
+
+// Fields compared by check.
+var verifiedFields = map[string]bool{
+	"email":         true,
+	"displayName":   true,
+	"emailVerified": true,
+	"providers":     true,
+}
+
+// check fetches the uploaded user back by local ID, or by email address if
+// not found, and reports the differences.
+func (up *uploader) check(u *gitkit.User) {
+	got, err := lookupUser(client.UserByLocalID(ctx, u.LocalID))
+	if err == nil && got == nil && u.Email != "" {
+		got, err = lookupUser(client.UserByEmail(ctx, u.Email))
+	}
+	if err != nil {
+		up.p.finish()
+		failOnError(up.c, err)
+	}
+	if got == nil {
+		up.p.printf(">> user %s (%s) not found after upload\n", u.Email, u.LocalID)
+		up.mismatched++
+		return
+	}
+	if diffs := diffUsers(u, got, verifiedFields); len(diffs) > 0 {
+		up.p.printf(">> user %s (%s) differs after upload: %s\n", u.Email, u.LocalID, strings.Join(diffs, "; "))
+		up.mismatched++
+	}
+}